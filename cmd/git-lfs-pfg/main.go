@@ -0,0 +1,78 @@
+// Command git-lfs-pfg is a Git LFS custom transfer agent storing LFS
+// objects next to the git objects of PeerForge repositories. Enable it in
+// a repository with:
+//
+//	git config lfs.standalonetransferagent pfg
+//	git config lfs.customtransfer.pfg.path git-lfs-pfg
+//
+// Uploads are added to the repository root by the next git push.
+package main
+
+import (
+	"os"
+	"strings"
+
+	_ "github.com/joho/godotenv/autoload"
+	"github.com/rs/zerolog/log"
+
+	"github.com/go-git/go-git/v5"
+
+	gitremotepfg "github.com/peerforge/peerforge/internal/git-remote-pfg"
+	"github.com/peerforge/peerforge/pkg/gitremote"
+	"github.com/peerforge/peerforge/pkg/lfs"
+	"github.com/peerforge/peerforge/pkg/logging"
+)
+
+func main() {
+	logFile, err := logging.Setup(logging.ConfigFromEnv())
+	if err != nil {
+		log.Fatal().Err(err).Send()
+	}
+	defer logFile.Close()
+
+	if os.Getenv("GIT_DIR") == "" {
+		cwd, err := os.Getwd()
+		if err != nil {
+			log.Fatal().Err(err).Send()
+		}
+		_ = os.Setenv("GIT_DIR", cwd)
+	}
+
+	agent := lfs.NewAgent(open)
+	if err := agent.Run(os.Stdin, os.Stdout); err != nil {
+		log.Fatal().Err(err).Send()
+	}
+}
+
+// open returns the handler of the PeerForge remote git lfs transfers
+// objects with, given by name or URL.
+func open(init lfs.Init) (lfs.Storage, error) {
+	localDir, err := gitremote.GetLocalDir()
+	if err != nil {
+		return nil, err
+	}
+
+	repo, err := git.PlainOpen(localDir)
+	if err != nil {
+		return nil, err
+	}
+
+	alias, url := init.Remote, init.Remote
+	if remote, err := repo.Remote(init.Remote); err == nil {
+		url = remote.Config().URLs[0]
+	} else {
+		alias = ""
+	}
+
+	// Transfers don't touch refs, so no tracker is needed.
+	handler, err := gitremotepfg.NewPfg(nil, alias, strings.TrimPrefix(url, gitremotepfg.URLScheme))
+	if err != nil {
+		return nil, err
+	}
+
+	if err = handler.Initialize(nil, repo, gitremote.NewOptions()); err != nil {
+		return nil, err
+	}
+
+	return handler, nil
+}
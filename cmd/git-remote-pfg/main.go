@@ -6,22 +6,18 @@ import (
 
 	shell "github.com/ipfs/go-ipfs-api"
 	_ "github.com/joho/godotenv/autoload"
-	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 
 	ipldgit "github.com/drgomesp/git-remote-ipldprime/core"
 
 	gitremotepfg "github.com/peerforge/peerforge/internal/git-remote-pfg"
 	"github.com/peerforge/peerforge/pkg/gitremote"
+	"github.com/peerforge/peerforge/pkg/logging"
 )
 
 const IpfsURL = "localhost:45005"
-const EmptyRepo = "QmUNLLsPACCz1vLxQVkXqqLX5R1X345qqfHbsf67hvA3Nn"
 
 func init() {
-	zerolog.SetGlobalLevel(zerolog.TraceLevel)
-	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
-
 	// TODO: remove this
 	if os.Getenv(shell.EnvDir) == "" {
 		_ = os.Setenv(shell.EnvDir, IpfsURL)
@@ -29,17 +25,27 @@ func init() {
 }
 
 func main() {
+	logFile, err := logging.Setup(logging.ConfigFromEnv())
+	if err != nil {
+		log.Fatal().Err(err).Send()
+	}
+	defer logFile.Close()
+
 	if len(os.Args) != 3 {
 		log.Fatal().Msg("gitremote-remote-pfg expects 2 arguments (origin name and url)")
 	}
 
-	remoteName := os.Args[2]
-	if strings.HasPrefix(remoteName, "pfg://") {
-		remoteName = remoteName[len("pfg://"):]
+	alias, remoteName := os.Args[1], os.Args[2]
+	if alias == remoteName {
+		alias = ""
+	}
+
+	if strings.HasPrefix(remoteName, gitremotepfg.URLScheme) {
+		remoteName = remoteName[len(gitremotepfg.URLScheme):]
 	}
 
 	if remoteName == "" {
-		remoteName = EmptyRepo
+		remoteName = gitremotepfg.EmptyRepo
 	}
 
 	if os.Getenv("GIT_DIR") == "" {
@@ -58,7 +64,7 @@ func main() {
 		}
 	}
 
-	handler, err := gitremotepfg.NewPfg(tracker, remoteName)
+	handler, err := gitremotepfg.NewPfg(tracker, alias, remoteName)
 	if err != nil {
 		log.Err(err).Send()
 	}
@@ -67,6 +73,7 @@ func main() {
 	if err != nil {
 		log.Fatal().Err(err).Send()
 	}
+	proto.OnVerbosity = logging.SetVerbosity
 
 	if err := proto.Run(os.Stdin, os.Stdout); err != nil {
 		log.Fatal().Err(err).Send()
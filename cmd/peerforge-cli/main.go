@@ -1,52 +1,91 @@
+// Command peerforge-cli sets up and manages PeerForge repositories.
 package main
 
-//
-//import (
-//	"os"
-//
-//	_ "github.com/joho/godotenv/autoload"
-//	"github.com/rs/zerolog"
-//	"github.com/rs/zerolog/log"
-//	rpchttp "github.com/tendermint/tendermint/rpc/client/http"
-//	"github.com/urfave/cli/v2"
-//
-//	"github.com/peerforge/peerforge/internal/peerforge-cli/repository"
-//)
-//
-//func init() {
-//	zerolog.SetGlobalLevel(zerolog.TraceLevel)
-//	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
-//}
-//
-//func main() {
-//	app := &cli.App{
-//		Name: "📡 peerforge-cli",
-//		Commands: []*cli.Command{
-//			{
-//				Name:      "init",
-//				Aliases:   []string{"i"},
-//				Usage:     `Initializes a project at a given directory`,
-//				ArgsUsage: "[dir]",
-//				Action: func(ctx *cli.Context) error {
-//					abciClient, err := rpchttp.New("http://localhost:26657")
-//					if err != nil {
-//						return err
-//					}
-//					initializer := repository.NewInitializer(abciClient)
-//					return initializer.Init(ctx.Args().Get(0))
-//				},
-//			},
-//			{
-//				Name: "t",
-//				Action: func(context *cli.Context) error {
-//
-//					return nil
-//				},
-//			},
-//		},
-//	}
-//
-//	if err := app.Run(os.Args); err != nil {
-//		log.Err(err).Send()
-//	}
-//}
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	_ "github.com/joho/godotenv/autoload"
+	"github.com/rs/zerolog/log"
+	rpchttp "github.com/tendermint/tendermint/rpc/client/http"
+
+	"github.com/peerforge/peerforge/internal/peerforge-cli/repository"
+	"github.com/peerforge/peerforge/pkg/logging"
+)
+
+// ABCIURL is the address of the node repositories are announced to.
+const ABCIURL = "http://localhost:26657"
+
+const usage = `usage: peerforge-cli <command> [arguments]
+
+commands:
+  init [dir]                    Initializes a project at a given directory
+  set-head [-dir dir] <branch>  Points the HEAD of the PeerForge remote at a branch
+  id                            Prints the peer ID repositories are published under
+`
+
+func main() {
+	logFile, err := logging.Setup(logging.ConfigFromEnv())
+	if err != nil {
+		log.Fatal().Err(err).Send()
+	}
+	defer logFile.Close()
+
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "init", "i":
+		err = runInit(args)
+	case "set-head":
+		err = runSetHead(args)
+	case "id":
+		err = runID()
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", cmd, usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		log.Err(err).Send()
+		os.Exit(1)
+	}
+}
+
+func runInit(args []string) error {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	_ = fs.Parse(args)
+
+	abciClient, err := rpchttp.New(ABCIURL)
+	if err != nil {
+		return err
+	}
+
+	return repository.NewInitializer(abciClient).Init(fs.Arg(0))
+}
+
+func runSetHead(args []string) error {
+	fs := flag.NewFlagSet("set-head", flag.ExitOnError)
+	dir := fs.String("dir", "", "repository directory")
+	_ = fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("set-head expects a branch name")
+	}
+
+	return repository.SetHead(*dir, fs.Arg(0))
+}
+
+func runID() error {
+	id, err := repository.Identity()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(id)
+
+	return nil
+}
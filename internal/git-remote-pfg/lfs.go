@@ -0,0 +1,220 @@
+package gitremotepfg
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"github.com/ipfs/go-cid"
+
+	"github.com/peerforge/peerforge/pkg/blobdag"
+	"github.com/peerforge/peerforge/pkg/lfs"
+)
+
+// LFSPendingFile lists, in the git directory, the LFS objects uploaded for
+// the next push. Git LFS uploads them before git pushes, from another
+// process, so they are handed over to the root by Commit through it.
+const LFSPendingFile = "pfg-lfs-pending.json"
+
+// lfsLockTimeout bounds the wait for another agent to release the lock of
+// LFSPendingFile.
+const lfsLockTimeout = 10 * time.Second
+
+var ErrLFSObjectNotFound = errors.New("lfs object not found")
+
+var _ lfs.Storage = &Pfg{}
+
+// Upload stores the LFS object at path and queues it for the next root.
+func (p *Pfg) Upload(ctx context.Context, oid string, path string) error {
+	// LFS uploads precede the push they belong to.
+	p.pushing = true
+
+	chunking, err := p.chunking(ctx)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// The chunks are stored as they are read. Those of an object whose
+	// content doesn't match its oid are left unreferenced.
+	h := sha256.New()
+	c, err := blobdag.WriteFrom(ctx, p.linkSys, io.TeeReader(f, h), int(chunking.ChunkSize))
+	if err != nil {
+		return err
+	}
+
+	if hex.EncodeToString(h.Sum(nil)) != oid {
+		return fmt.Errorf("lfs object %s: content doesn't match its oid", oid)
+	}
+
+	return p.updatePendingLFS(ctx, func(pending map[string]cid.Cid) {
+		pending[oid] = c
+	})
+}
+
+// Download writes the LFS object oid, from the root or from the uploads
+// not pushed yet, to w as its chunks are loaded, and fails once done if
+// they don't add up to its content.
+func (p *Pfg) Download(ctx context.Context, oid string, w io.Writer) error {
+	root, err := p.loadRoot(ctx)
+	if err != nil {
+		return err
+	}
+
+	c, ok := root.LFS[oid]
+	if !ok {
+		pending, err := p.pendingLFS()
+		if err != nil {
+			return err
+		}
+
+		if c, ok = pending[oid]; !ok {
+			return fmt.Errorf("%w: %s", ErrLFSObjectNotFound, oid)
+		}
+	}
+
+	h := sha256.New()
+	if err = blobdag.Copy(ctx, p.linkSys, c, io.MultiWriter(w, h)); err != nil {
+		return err
+	}
+
+	if hex.EncodeToString(h.Sum(nil)) != oid {
+		return fmt.Errorf("lfs object %s: stored content doesn't match its oid", oid)
+	}
+
+	return nil
+}
+
+// pendingLFS reads LFSPendingFile, missing when nothing was uploaded.
+func (p *Pfg) pendingLFS() (map[string]cid.Cid, error) {
+	pending := map[string]cid.Cid{}
+
+	data, err := os.ReadFile(p.lfsPendingPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return pending, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries map[string]string
+	if err = json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("%s: %w", LFSPendingFile, err)
+	}
+
+	for oid, s := range entries {
+		if pending[oid], err = cid.Decode(s); err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", LFSPendingFile, oid, err)
+		}
+	}
+
+	return pending, nil
+}
+
+// updatePendingLFS applies update to the LFS uploads listed in
+// LFSPendingFile. Git LFS runs several agents at once, so as git does with
+// its own files, the new list is written to a lock file created
+// exclusively, then renamed over LFSPendingFile: agents never lose each
+// other's uploads and readers never see a partial file.
+func (p *Pfg) updatePendingLFS(ctx context.Context, update func(pending map[string]cid.Cid)) error {
+	lock, err := p.lockPendingLFS(ctx)
+	if err != nil {
+		return err
+	}
+
+	renamed := false
+	defer func() {
+		if !renamed {
+			_ = lock.Close()
+			_ = os.Remove(lock.Name())
+		}
+	}()
+
+	pending, err := p.pendingLFS()
+	if err != nil {
+		return err
+	}
+
+	update(pending)
+
+	if len(pending) == 0 {
+		err := os.Remove(p.lfsPendingPath())
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+
+		return err
+	}
+
+	entries := make(map[string]string, len(pending))
+	for oid, c := range pending {
+		entries[oid] = c.String()
+	}
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if _, err = lock.Write(data); err != nil {
+		return err
+	}
+	if err = lock.Close(); err != nil {
+		return err
+	}
+
+	if err = os.Rename(lock.Name(), p.lfsPendingPath()); err != nil {
+		return err
+	}
+	renamed = true
+
+	return nil
+}
+
+// lockPendingLFS creates the lock file of LFSPendingFile, waiting up to
+// lfsLockTimeout for another agent to release it.
+func (p *Pfg) lockPendingLFS(ctx context.Context) (*os.File, error) {
+	path := p.lfsPendingPath() + ".lock"
+	deadline := time.Now().Add(lfsLockTimeout)
+
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if !errors.Is(err, os.ErrExist) {
+			return f, err
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%s exists: remove it if no push or lfs transfer is running", path)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// lfsPendingPath returns where LFSPendingFile is, in the git directory
+// whether GIT_DIR points at it or at the worktree.
+func (p *Pfg) lfsPendingPath() string {
+	dir := p.localDir
+	if st, ok := p.repo.Storer.(*filesystem.Storage); ok {
+		dir = st.Filesystem().Root()
+	}
+
+	return filepath.Join(dir, LFSPendingFile)
+}
@@ -0,0 +1,112 @@
+package gitremotepfg
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/peerforge/peerforge/pkg/gitremote"
+)
+
+func TestPfg_UploadDownload(t *testing.T) {
+	p, _, _ := newTestPfg(t)
+	p.config.ChunkSize = 1 << 10
+	ctx := context.Background()
+
+	content := bytes.Repeat([]byte("lfs object "), 1000)
+	sum := sha256.Sum256(content)
+	oid := hex.EncodeToString(sum[:])
+
+	path := filepath.Join(t.TempDir(), "object")
+	assert.NoError(t, os.WriteFile(path, content, 0644))
+
+	assert.Error(t, p.Upload(ctx, hex.EncodeToString(make([]byte, sha256.Size)), path), "content doesn't match the oid")
+	assert.NoError(t, p.Upload(ctx, oid, path))
+
+	var buf bytes.Buffer
+	assert.NoError(t, p.Download(ctx, oid, &buf), "from the pending uploads")
+	assert.Equal(t, content, buf.Bytes())
+
+	commitFile(t, p.repo, "small.txt", []byte("hello\n"))
+	_, err := p.Push(ctx, "refs/heads/master", "refs/heads/main", false)
+	assert.NoError(t, err)
+	assert.NoError(t, p.Commit(ctx))
+
+	buf.Reset()
+	assert.NoError(t, p.Download(ctx, oid, &buf), "from the root")
+	assert.Equal(t, content, buf.Bytes())
+
+	assert.ErrorIs(t, p.Download(ctx, hex.EncodeToString(make([]byte, sha256.Size)), &buf), ErrLFSObjectNotFound)
+}
+
+func TestPfg_UploadConcurrentAgents(t *testing.T) {
+	p, _, _ := newTestPfg(t)
+	ctx := context.Background()
+
+	// Git LFS runs several agents at once, each with its own handler on
+	// the same repository.
+	const agents = 16
+
+	oids := make([]string, agents)
+	var wg sync.WaitGroup
+	for i := 0; i < agents; i++ {
+		content := []byte(fmt.Sprintf("lfs object %d\n", i))
+		sum := sha256.Sum256(content)
+		oids[i] = hex.EncodeToString(sum[:])
+
+		path := filepath.Join(t.TempDir(), "object")
+		assert.NoError(t, os.WriteFile(path, content, 0644))
+
+		agent := &Pfg{
+			linkSys:  p.linkSys,
+			repo:     p.repo,
+			store:    p.store,
+			options:  gitremote.NewOptions(),
+			config:   p.config,
+			localDir: p.localDir,
+		}
+
+		wg.Add(1)
+		go func(oid string) {
+			defer wg.Done()
+			assert.NoError(t, agent.Upload(ctx, oid, path))
+		}(oids[i])
+	}
+	wg.Wait()
+
+	pending, err := p.pendingLFS()
+	assert.NoError(t, err)
+	for _, oid := range oids {
+		assert.Contains(t, pending, oid)
+	}
+}
+
+func TestPfg_UploadLocked(t *testing.T) {
+	p, _, _ := newTestPfg(t)
+
+	lock := p.lfsPendingPath() + ".lock"
+	assert.NoError(t, os.WriteFile(lock, nil, 0644))
+
+	path := filepath.Join(t.TempDir(), "object")
+	assert.NoError(t, os.WriteFile(path, []byte("lfs\n"), 0644))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err := p.Upload(ctx, "64fc7da9eafea5e011f98d6cce8340fd7e812ce81a92259413d2f8b527c84f8c", path)
+	assert.ErrorIs(t, err, context.DeadlineExceeded, "waits for the other agent")
+	assert.FileExists(t, lock, "the lock of the other agent is left alone")
+
+	pending, err := p.pendingLFS()
+	assert.NoError(t, err)
+	assert.Empty(t, pending)
+}
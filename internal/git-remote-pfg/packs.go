@@ -0,0 +1,111 @@
+package gitremotepfg
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/ipfs/go-cid"
+
+	"github.com/peerforge/peerforge/pkg/repo"
+)
+
+// layout returns the layout pushes store objects with: as configured, else
+// as recorded in the current root, else one block per object.
+func (p *Pfg) layout(ctx context.Context) (string, error) {
+	if p.config.Layout != "" {
+		return p.config.Layout, repo.CheckLayout(p.config.Layout)
+	}
+
+	root, err := p.loadRoot(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if root.Layout != "" {
+		return root.Layout, repo.CheckLayout(root.Layout)
+	}
+
+	return repo.LayoutObjects, nil
+}
+
+// packObject reads the object sha from the packs of the repository, the
+// latest first, or returns nil when none of them has it.
+func (p *Pfg) packObject(ctx context.Context, sha string) ([]byte, error) {
+	root, err := p.loadRoot(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(root.Packs) - 1; i >= 0; i-- {
+		idx, err := p.packIndex(ctx, root.Packs[i])
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := idx.Object(ctx, p.linkSys, sha)
+		if err != nil || data != nil {
+			return data, err
+		}
+	}
+
+	return nil, nil
+}
+
+// packIndex loads the pack index c, once per session.
+func (p *Pfg) packIndex(ctx context.Context, c cid.Cid) (*repo.PackIndex, error) {
+	p.packMu.Lock()
+	defer p.packMu.Unlock()
+
+	if idx, ok := p.packIndexes[c]; ok {
+		return idx, nil
+	}
+
+	idx, err := repo.LoadPackIndex(ctx, p.linkSys, c)
+	if err != nil {
+		return nil, fmt.Errorf("pack index %s: %w", c, err)
+	}
+
+	if p.packIndexes == nil {
+		p.packIndexes = map[cid.Cid]*repo.PackIndex{}
+	}
+	p.packIndexes[c] = idx
+
+	return idx, nil
+}
+
+// Packs lists the pack indexes of the repository, which identify its
+// packs.
+func (p *Pfg) Packs(ctx context.Context) ([]string, error) {
+	root, err := p.loadRoot(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, len(root.Packs))
+	for i, c := range root.Packs {
+		ids[i] = c.String()
+	}
+
+	return ids, nil
+}
+
+// Pack reads the whole packfile indexed by id.
+func (p *Pfg) Pack(ctx context.Context, id string) (io.ReadCloser, error) {
+	c, err := cid.Decode(id)
+	if err != nil {
+		return nil, fmt.Errorf("pack %q: %w", id, err)
+	}
+
+	idx, err := p.packIndex(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := idx.ReadPack(ctx, p.linkSys)
+	if err != nil {
+		return nil, fmt.Errorf("pack %s: %w", id, err)
+	}
+
+	return io.NopCloser(r), nil
+}
@@ -3,62 +3,80 @@
 package gitremotepfg
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path"
+	"strconv"
 	"strings"
+	"sync"
 
-	"github.com/davecgh/go-spew/spew"
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/ipfs/go-cid"
 	"github.com/ipld/go-ipld-prime"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
-	"github.com/ipld/go-ipld-prime/storage"
+	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/rs/zerolog/log"
 
-	gitremote "github.com/drgomesp/git-remote-ipldprime"
 	"github.com/drgomesp/git-remote-ipldprime/core"
 	ipldgitprime "github.com/drgomesp/go-ipld-gitprime"
 	"github.com/drgomesp/go-ipld-gitprime/store"
-)
-
-type IPFS interface {
-	DagPut(data interface{}, inputCodec, storeCodec string) (string, error)
-	Add(r io.Reader, options ...interface{}) (string, error)
-	PatchLink(root, path, childhash string, create bool) (string, error)
-	Get(hash, outdir string) error
-	List(path string) ([]ipld.Link, error)
-	Cat(path string) (io.ReadCloser, error)
-	ResolvePath(path string) (string, error)
-}
 
-const (
-	LargeObjectDir    = "objects"
-	LObjTrackerPrefix = "//lobj"
-	HEAD              = "HEAD"
+	"github.com/peerforge/peerforge/pkg/blobdag"
+	"github.com/peerforge/peerforge/pkg/config"
+	"github.com/peerforge/peerforge/pkg/gitfmt"
+	"github.com/peerforge/peerforge/pkg/gitremote"
+	"github.com/peerforge/peerforge/pkg/naming"
+	"github.com/peerforge/peerforge/pkg/repo"
 )
 
 const (
-	RefPathHead = iota
-	RefPathRef
+	// LargeObjectThreshold is the default size above which git objects are
+	// kept out of the regular object store.
+	LargeObjectThreshold = 1 << 21
+
+	HEAD         = "HEAD"
+	URLScheme    = "pfg://"
+	BranchPrefix = "refs/heads/"
+	TagPrefix    = "refs/tags/"
+	// EnvNodeURL overrides the node of the repository configuration.
+	EnvNodeURL = "PFG_NODE_URL"
+	// EmptyRepo is the remote name standing for a repository never pushed
+	// to, as given for a bare pfg:// URL.
+	EmptyRepo = "QmUNLLsPACCz1vLxQVkXqqLX5R1X345qqfHbsf67hvA3Nn"
 )
 
+// ErrUnknownRemote is returned for remote names that are neither a root
+// CID, a name nor EmptyRepo, such as the CIDs of storage formats older
+// than repository roots.
+var ErrUnknownRemote = errors.New("not a repository root or name")
+
 const (
 	RepositoryInitialized = "repository.Initialized"
 )
 
-type refPath struct {
-	path  string
-	rType int
+// defaultBranches are the candidates HEAD is repointed to when the branch
+// it refers to gets deleted, after the configured default branch.
+var defaultBranches = []string{"refs/heads/main", "refs/heads/master"}
 
-	hash string
+// refUpdate is a ref change staged until Commit. An empty hash deletes it.
+// peeled is set when hash is an annotated tag.
+type refUpdate struct {
+	ref    string
+	hash   string
+	peeled string
 }
 
-var _ gitremote.ProtocolHandler = &Pfg{}
+var (
+	_ gitremote.ProtocolHandler    = &Pfg{}
+	_ gitremote.ObjectProvider     = &Pfg{}
+	_ gitremote.ObjectSizer        = &Pfg{}
+	_ gitremote.StatelessConnector = &Pfg{}
+	_ gitremote.PackProvider       = &Pfg{}
+)
 
 type Pfg struct {
 	linkSys *ipld.LinkSystem
@@ -66,14 +84,47 @@ type Pfg struct {
 	store   ipldgitprime.Store
 	tracker *core.Tracker
 
-	largeObjs   map[string]string
-	pushed      bool
+	options *gitremote.Options
+	config  *config.Config
+	// stderr receives the messages meant for the user.
+	stderr io.Writer
+	// root is the latest root of the repository, stored under rootCid
+	// unless the repository was never pushed to.
+	root    *repo.Root
+	rootCid cid.Cid
+	// baseCid is the root the session started from.
+	baseCid cid.Cid
+	updates []refUpdate
+	// objects are the large objects stored during the session, added to
+	// the next root.
+	objects map[string]cid.Cid
+	// packs are the pack indexes stored during the current batch, added to
+	// the next root, and packed the objects they hold.
+	packs  []cid.Cid
+	packed map[plumbing.Hash]struct{}
+	// packIndexes caches the pack indexes loaded to serve objects, guarded
+	// by packMu.
+	packMu      sync.Mutex
+	packIndexes map[cid.Cid]*repo.PackIndex
 	localDir    string
-	remoteName  string
-	currentHash string
+	// alias is the name of the git remote, empty when git was given a URL.
+	alias      string
+	remoteName string
+	// name is set when remoteName is a name rather than a root CID. New
+	// roots are then published with identity.
+	name     *naming.Name
+	resolver *naming.Resolver
+	identity crypto.PrivKey
+	// pushing is set when the session pushes, which may publish a name
+	// that doesn't resolve yet.
+	pushing bool
 }
 
-func NewPfg(tracker *core.Tracker, remoteName string) (*Pfg, error) {
+// NewPfg returns a handler for the repository remoteName, as found in the
+// pfg:// URL of the git remote alias: a root CID or a name such as
+// "<peer id>/<repo>". Pass an empty alias for remotes given to git as a
+// bare URL, and a nil tracker for handlers that don't push.
+func NewPfg(tracker *core.Tracker, alias string, remoteName string) (*Pfg, error) {
 	cwd, _ := os.Getwd()
 
 	localDir, err := gitremote.GetLocalDir()
@@ -99,12 +150,34 @@ func NewPfg(tracker *core.Tracker, remoteName string) (*Pfg, error) {
 		return nil, err
 	}
 
-	return &Pfg{tracker: tracker, linkSys: &ls, store: st, repo: repo, remoteName: remoteName}, nil
+	dir, err := naming.DefaultDir()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Pfg{
+		tracker:    tracker,
+		linkSys:    &ls,
+		store:      st,
+		repo:       repo,
+		objects:    map[string]cid.Cid{},
+		packed:     map[plumbing.Hash]struct{}{},
+		alias:      alias,
+		remoteName: remoteName,
+		stderr:     os.Stderr,
+		resolver:   naming.NewResolver(dir),
+	}
+
+	if name, err := naming.ParseName(remoteName); err == nil {
+		p.name = &name
+	}
+
+	return p, nil
 }
 
-func (p *Pfg) Initialize(tracker *core.Tracker, repo *git.Repository) error {
+func (p *Pfg) Initialize(tracker *core.Tracker, repo *git.Repository, options *gitremote.Options) error {
 	p.repo = repo
-	p.currentHash = p.remoteName
+	p.options = options
 
 	localDir, err := gitremote.GetLocalDir()
 	if err != nil {
@@ -119,273 +192,749 @@ func (p *Pfg) Initialize(tracker *core.Tracker, repo *git.Repository) error {
 	p.localDir = localDir
 	p.repo = repo
 
-	return nil
+	return p.loadConfig()
 }
 
-func (p *Pfg) Finish() error {
-	if p.pushed {
-		if err := p.fillMissingLobjs(p.tracker); err != nil {
+// loadConfig reads .peerforge.yaml from the worktree, bare repositories
+// having none, and applies the pfg section of the git configuration.
+func (p *Pfg) loadConfig() error {
+	p.config = &config.Config{}
+
+	w, err := p.repo.Worktree()
+	switch {
+	case err == nil:
+		if p.config, err = config.Load(w.Filesystem.Root()); err != nil {
 			return err
 		}
+	case err != git.ErrIsBareRepository:
+		return err
+	}
+
+	cfg, err := p.repo.Config()
+	if err != nil {
+		return err
+	}
+
+	return p.config.ApplyGitConfig(cfg.Raw)
+}
 
-		log.Printf("Pushed to IPFS as \x1b[32mipld://%s\x1b[39m\n", p.currentHash)
+// chunking returns how to store large objects: as configured, else as
+// recorded in the current root, else with the defaults.
+func (p *Pfg) chunking(ctx context.Context) (repo.Chunking, error) {
+	root, err := p.loadRoot(ctx)
+	if err != nil {
+		return repo.Chunking{}, err
 	}
 
-	return nil
+	c := root.Chunking
+	if p.config.LargeObjectThreshold != 0 {
+		c.Threshold = int64(p.config.LargeObjectThreshold)
+	}
+	if c.Threshold == 0 {
+		c.Threshold = LargeObjectThreshold
+	}
+
+	if p.config.ChunkSize != 0 {
+		c.ChunkSize = int64(p.config.ChunkSize)
+	}
+	if c.ChunkSize == 0 {
+		c.ChunkSize = blobdag.DefaultChunkSize
+	}
+
+	return c, blobdag.CheckChunkSize(int(c.ChunkSize))
 }
 
-func (p *Pfg) ProvideBlock(cid string, tracker *core.Tracker) ([]byte, error) {
-	if p.largeObjs == nil {
-		if err := p.loadObjectMap(); err != nil {
-			return nil, err
-		}
+func (p *Pfg) Finish() error {
+	if p.rootCid == p.baseCid {
+		return nil
 	}
 
-	mappedCid, ok := p.largeObjs[cid]
+	if p.options.Verbosity > 0 {
+		_, _ = fmt.Fprintf(p.stderr, "%s is now at pfg://%s\n", p.remoteLabel(), p.rootCid)
+	}
+
+	if p.name != nil {
+		return p.resolver.Publish(p.identity, *p.name, p.rootCid)
+	}
+
+	return p.updateRemoteURL()
+}
+
+// remoteLabel names the remote in messages: its alias when it has one,
+// its URL otherwise.
+func (p *Pfg) remoteLabel() string {
+	if p.alias != "" {
+		return p.alias
+	}
+
+	return URLScheme + p.remoteName
+}
+
+// updateRemoteURL points the URL of the remote at the latest root, so later
+// fetches and pushes start from it. Remotes used through a bare URL have
+// nothing to update, and named ones are updated by publishing the name.
+func (p *Pfg) updateRemoteURL() error {
+	if p.alias == "" {
+		return nil
+	}
+
+	cfg, err := p.repo.Config()
+	if err != nil {
+		return err
+	}
+
+	remote, ok := cfg.Remotes[p.alias]
 	if !ok {
-		return nil, core.ErrNotProvided
+		return nil
 	}
 
-	if err := tracker.Set(LObjTrackerPrefix+"/"+cid, []byte(mappedCid)); err != nil {
+	for i, u := range remote.URLs {
+		if u == URLScheme+p.remoteName || u == URLScheme {
+			remote.URLs[i] = URLScheme + p.rootCid.String()
+		}
+	}
+
+	return p.repo.SetConfig(cfg)
+}
+
+// ProvideBlock serves the blocks core can't find in the store, which are
+// the large objects indexed by the repository root and the objects of its
+// packs.
+func (p *Pfg) ProvideBlock(identifier string, tracker *core.Tracker) ([]byte, error) {
+	sha, err := gitHash(identifier)
+	if err != nil {
 		return nil, err
 	}
 
-	data, err := p.store.Get(context.TODO(), mappedCid)
+	data, err := p.largeObject(context.TODO(), sha)
+	if data == nil && err == nil {
+		data, err = p.packObject(context.TODO(), sha)
+	}
+	if data == nil && err == nil {
+		return nil, core.ErrNotProvided
+	}
+
+	return data, err
+}
+
+// Object returns the git object sha in its loose form, from the object
+// store, from the blobdag of a large object or from a pack.
+func (p *Pfg) Object(ctx context.Context, sha string) ([]byte, error) {
+	c, err := gitremote.CidFromHex(sha)
 	if err != nil {
-		return nil, errors.New("get error")
+		return nil, err
 	}
 
-	err = p.store.Put(context.TODO(), "raw", data)
+	key := cidlink.Link{Cid: c}.Binary()
+
+	has, err := p.store.Has(ctx, key)
 	if err != nil {
 		return nil, err
 	}
+	if has {
+		return p.store.Get(ctx, key)
+	}
 
-	//if realCid != cid {
-	//	return nil, fmt.Errorf("unexpected cid for provided block %s != %s", realCid, cid)
-	//}
+	data, err := p.largeObject(ctx, sha)
+	if data == nil && err == nil {
+		data, err = p.packObject(ctx, sha)
+	}
+	if data == nil && err == nil {
+		return nil, plumbing.ErrObjectNotFound
+	}
 
-	return data, nil
+	return data, err
 }
 
-func (p *Pfg) loadObjectMap() error {
-	p.largeObjs = map[string]string{}
+// ObjectSize returns the size of the content of the git object sha. Large
+// objects are sized from the root of their blobdag alone.
+func (p *Pfg) ObjectSize(ctx context.Context, sha string) (int64, error) {
+	root, err := p.loadRoot(ctx)
+	if err != nil {
+		return 0, err
+	}
 
-	links, err := p.store.Get(context.TODO(), path.Join(p.currentHash, HEAD))
+	if c, ok := root.Objects[sha]; ok {
+		size, err := blobdag.Size(ctx, p.linkSys, c)
+		if err != nil {
+			return 0, fmt.Errorf("large object %s: %w", sha, err)
+		}
+
+		return blobSize(size), nil
+	}
+
+	raw, err := p.Object(ctx, sha)
+	if err != nil {
+		return 0, err
+	}
+
+	obj, err := gitremote.ParseLooseObject(plumbing.NewHash(sha), raw)
 	if err != nil {
-		if isNoLink(err) {
-			return nil
+		return 0, err
+	}
+
+	return obj.Size(), nil
+}
+
+// blobSize returns the size of the content of a blob whose loose form,
+// "blob <size>\x00<content>", is loose bytes long.
+func blobSize(loose int64) int64 {
+	const header = int64(len("blob \x00"))
+
+	for digits := int64(1); digits < 20; digits++ {
+		size := loose - header - digits
+		if size >= 0 && int64(len(strconv.FormatInt(size, 10))) == digits {
+			return size
 		}
+	}
 
-		return err
+	return loose
+}
+
+// largeObject reads the object sha from its blobdag, or returns nil when
+// it isn't a large object of the repository.
+func (p *Pfg) largeObject(ctx context.Context, sha string) ([]byte, error) {
+	root, err := p.loadRoot(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	spew.Printf("links=%v\n", links)
-	//for _, link := range links {
-	//	h.largeObjs[link.Name] = link.Hash
-	//}
+	c, ok := root.Objects[sha]
+	if !ok {
+		return nil, nil
+	}
 
-	return nil
+	data, err := blobdag.Read(ctx, p.linkSys, c)
+	if err != nil {
+		return nil, fmt.Errorf("large object %s: %w", sha, err)
+	}
+
+	return data, nil
 }
 
 func (p *Pfg) Capabilities() string {
-	return gitremote.DefaultCapabilities
+	return gitremote.DefaultCapabilities + "\n" + gitremote.CmdStatelessConnect
 }
 
-func (p *Pfg) List(forPush bool) ([]string, error) {
-	ctx := context.Background()
-	out := make([]string, 0)
+// ServiceURL points the protocol v2 sessions of git at the node serving the
+// repository, as configured or from PFG_NODE_URL. Pushes always go through
+// the helper, which keeps the root of the repository up to date.
+func (p *Pfg) ServiceURL(service string) (string, error) {
+	node := p.config.Node
+	if env := os.Getenv(EnvNodeURL); env != "" {
+		node = env
+	}
 
-	if !forPush {
-		refs, err := p.paths(ctx, nil, p.remoteName, 0)
-		if err != nil {
-			return nil, err
-		}
+	if node == "" || service != "git-upload-pack" {
+		return "", nil
+	}
 
-		for _, ref := range refs {
-			switch ref.rType {
-			case RefPathHead:
-				r := path.Join(strings.Split(ref.path, "/")[1:]...)
-				c, err := core.CidFromHex(ref.hash)
-				if err != nil {
-					return nil, err
-				}
-
-				hash, err := core.HexFromCid(c)
-				if err != nil {
-					return nil, err
-				}
-
-				out = append(out, fmt.Sprintf("%s %s", hash, r))
-			case RefPathRef:
-				r := path.Join(strings.Split(ref.path, "/")[1:]...)
-				dest, err := p.getRef(ctx, r)
-				if err != nil {
-					return nil, err
-				}
-				out = append(out, fmt.Sprintf("@%s %s", dest, r))
-			}
+	return strings.TrimSuffix(node, "/") + "/" + p.remoteName, nil
+}
 
-		}
-	} else {
+// List returns the remote refs with their hashes and HEAD as a symref.
+// Git gets the same listing for fetches and pushes, the latter needing
+// the current tips to find what to send and to spot non-fast-forwards.
+func (p *Pfg) List(forPush bool) ([]string, error) {
+	p.pushing = p.pushing || forPush
+
+	root, err := p.loadRoot(context.Background())
+	if err != nil {
+		return nil, err
+	}
 
+	out := make([]string, 0, len(root.Refs)+1)
+	if root.Head != "" {
+		out = append(out, fmt.Sprintf("@%s %s", root.Head, HEAD))
+	}
+
+	for _, name := range root.Refs.Names() {
+		out = append(out, fmt.Sprintf("%s %s", root.Refs[name], name))
 	}
 
 	return out, nil
 }
 
-func (p *Pfg) Push(ctx context.Context, local string, remote string) (string, error) {
-	p.pushed = true
-
+func (p *Pfg) Push(ctx context.Context, local string, remote string, force bool) (string, error) {
 	localRef, err := p.repo.Reference(plumbing.ReferenceName(local), true)
+	if err != nil {
+		return "", &gitremote.RefError{Ref: remote, Err: err}
+	}
+
+	hash := localRef.Hash()
+
+	peeled, err := p.peel(hash)
 	if err != nil {
 		return "", err
 	}
 
-	headHash := localRef.Hash().String()
+	refs, err := p.remoteRefs(ctx)
+	if err != nil {
+		return "", err
+	}
 
-	push := core.NewPush(p.localDir, p.tracker, p.linkSys, p.repo, p.store)
-	push.NewNode = p.bigNodePatcher(p.tracker)
+	old, exists := refs[remote]
+	if !force && exists {
+		if err := p.checkUpdate(refs, remote, hash, peeled); err != nil {
+			return "", err
+		}
+	}
 
-	err = push.PushHash(headHash)
+	chunking, err := p.chunking(ctx)
 	if err != nil {
 		return "", err
 	}
 
-	c, err := core.CidFromHex(headHash)
+	haves, err := p.remoteHaves(ctx)
 	if err != nil {
 		return "", err
 	}
 
-	k := path.Join(p.currentHash, remote)
-	err = p.store.Put(ctx, k, bytes.NewBufferString(headHash).Bytes())
+	// Annotated tags are walked through to their target, so hashes holds
+	// the history a tag points at along with the tag itself.
+	hashes, err := p.pendingObjects(hash, haves)
+	if err != nil {
+		return "", err
+	}
 
-	head, err := p.getRef(ctx, HEAD)
+	layout, err := p.layout(ctx)
 	if err != nil {
 		return "", err
 	}
 
-	if head == nil {
-		if err = p.store.Put(
-			ctx,
-			path.Join(p.currentHash, HEAD),
-			bytes.NewBufferString("refs/heads/main").Bytes(),
-		); err != nil {
-			return "", err
-		}
+	// A dry run goes through the whole push, only writing through a
+	// LinkSystem that stores nothing, so that Commit can tell the root a
+	// real push would end up with.
+	progress := p.options.NewProgress("Writing objects", len(hashes))
+	if p.options.DryRun {
+		progress = nil
+	}
 
-		k = path.Join(c.String(), HEAD)
-		if err = p.store.Put(ctx, k, c.Bytes()); err != nil {
-			return "", err
-		}
+	var stats pushStats
+	if layout == repo.LayoutPacks {
+		stats, err = p.uploadPack(ctx, hashes, chunking, progress)
+	} else {
+		stats, err = p.upload(ctx, hashes, chunking, progress)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	progress.Done()
 
-		p.currentHash = k
+	if p.options.DryRun {
+		p.reportDryRun(remote, old, hash, stats)
 	}
 
+	update := refUpdate{ref: remote, hash: hash.String()}
+	if peeled != hash {
+		update.peeled = peeled.String()
+	}
+
+	p.updates = append(p.updates, update)
+
 	return local, nil
 }
 
-func (p *Pfg) bigNodePatcher(tracker *core.Tracker) func(context.Context, string, []byte) error {
-	return func(ctx context.Context, hash string, data []byte) error {
-		log.Debug().Msgf("size: %vb", len(data))
-		if len(data) > (1 << 21) {
-			log.Debug().Msgf(" > less than: %vb", 1<<21)
-			if err := p.store.Put(ctx, p.currentHash, data); err != nil {
-				return err
-			}
+// checkUpdate rejects a non-forced update of an existing remote ref. Tags
+// can't move at all, other refs only by fast-forward of their peeled value.
+func (p *Pfg) checkUpdate(refs repo.Refs, remote string, hash, peeled plumbing.Hash) error {
+	old := refs[remote]
+	if old == hash.String() {
+		return nil
+	}
+
+	if strings.HasPrefix(remote, TagPrefix) {
+		return &gitremote.RefError{Ref: remote, Err: gitremote.ErrAlreadyExists}
+	}
+
+	if oldPeeled, ok := refs[remote+gitfmt.PeeledSuffix]; ok {
+		old = oldPeeled
+	}
+
+	ff, err := p.isFastForward(plumbing.NewHash(old), peeled)
+	if err != nil {
+		return err
+	}
 
-			if err := tracker.Set(LObjTrackerPrefix+"/"+hash, []byte(nil)); err != nil {
-				return err
-			}
+	if !ff {
+		return &gitremote.RefError{Ref: remote, Err: gitremote.ErrNonFastForward}
+	}
 
-			k := path.Join(p.currentHash, "objects", hash[:2], hash[2:])
-			if err := p.store.Put(ctx, k, data); err != nil {
-				return err
-			}
+	return nil
+}
 
-			p.currentHash = k
+// peel follows annotated tags, nested ones included, down to the object
+// they eventually point at. Any other object peels to itself.
+func (p *Pfg) peel(hash plumbing.Hash) (plumbing.Hash, error) {
+	for {
+		tag, err := p.repo.TagObject(hash)
+		if err == plumbing.ErrObjectNotFound {
+			return hash, nil
+		}
+		if err != nil {
+			return plumbing.ZeroHash, err
 		}
 
-		return nil
+		hash = tag.Target
 	}
 }
 
-func (p *Pfg) getRef(ctx context.Context, name string) ([]byte, error) {
-	key := path.Join(p.remoteName, name)
+// isFastForward reports whether moving a ref from old to new keeps old in
+// the history of new. An old tip missing from the local repository can't be
+// verified and is treated as a non-fast-forward, as git does.
+func (p *Pfg) isFastForward(old, new plumbing.Hash) (bool, error) {
+	if old == new {
+		return true, nil
+	}
 
-	has, err := p.store.Has(ctx, key)
+	oldCommit, err := p.repo.CommitObject(old)
+	if err == plumbing.ErrObjectNotFound {
+		return false, nil
+	}
 	if err != nil {
-		return nil, err
+		return false, err
 	}
 
-	if !has {
-		return nil, nil
+	newCommit, err := p.repo.CommitObject(new)
+	if err != nil {
+		return false, err
 	}
 
-	data, err := p.store.(storage.ReadableStorage).Get(ctx, key)
+	return oldCommit.IsAncestor(newCommit)
+}
+
+func (p *Pfg) Delete(ctx context.Context, remote string) error {
+	refs, err := p.remoteRefs(ctx)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return data, nil
+	if _, ok := refs[remote]; !ok {
+		return &gitremote.RefError{Ref: remote, Err: gitremote.ErrRefNotFound}
+	}
+
+	p.updates = append(p.updates, refUpdate{ref: remote})
+
+	return nil
 }
 
-func (p *Pfg) paths(ctx context.Context, api IPFS, pth string, level int) ([]refPath, error) {
-	//links, err := api.List(pth)
-	//ref, err := p.getRef(ctx, pth)
+// Commit applies the ref updates staged by Push and Delete during the
+// current batch, storing them as a new root on top of the current one.
+// During a dry run, the root is only reported.
+func (p *Pfg) Commit(ctx context.Context) error {
+	updates := p.updates
+	p.updates = nil
+
+	if len(updates) == 0 {
+		return nil
+	}
+
+	next, err := p.nextRoot(ctx, updates)
+	if err != nil {
+		return err
+	}
+
+	if p.options.DryRun {
+		return p.dryRunCommit(ctx, next, updates)
+	}
 
-	//if err != nil {
-	//	panic(err)
-	//}
+	if err = p.storeRoot(ctx, next); err != nil {
+		return err
+	}
+
+	// The tracker only learns about the refs once a root refers to them,
+	// so a failed batch never leaves it ahead of the repository. Entries
+	// of deleted refs are left as they are: remote refs are always listed
+	// from the root, never from the tracker, so they are never read.
+	for _, u := range updates {
+		if u.hash == "" {
+			continue
+		}
 
-	out := make([]refPath, 0)
+		h := plumbing.NewHash(u.hash)
+		if err = p.tracker.Set(u.ref, h[:]); err != nil {
+			return err
+		}
+	}
 
-	//if ref != nil {
-	v, err := p.store.Get(ctx, path.Join(pth, HEAD))
+	// Uploads made since nextRoot read the list wait for the next push.
+	return p.updatePendingLFS(ctx, func(pending map[string]cid.Cid) {
+		for oid := range next.LFS {
+			delete(pending, oid)
+		}
+	})
+}
+
+// nextRoot returns the root on top of the current one with updates and
+// everything else the batch staged applied.
+func (p *Pfg) nextRoot(ctx context.Context, updates []refUpdate) (*repo.Root, error) {
+	current, err := p.loadRoot(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	next := current.Next(p.rootCid)
+	for _, u := range updates {
+		if u.hash == "" {
+			delete(next.Refs, u.ref)
+		} else {
+			next.Refs[u.ref] = u.hash
+		}
+
+		if u.peeled == "" {
+			delete(next.Refs, u.ref+gitfmt.PeeledSuffix)
+		} else {
+			next.Refs[u.ref+gitfmt.PeeledSuffix] = u.peeled
+		}
+	}
+
+	for hash, c := range p.objects {
+		next.Objects[hash] = c
+	}
+
+	next.Packs = append(next.Packs, p.packs...)
+	p.packs = nil
+
+	layout, err := p.layout(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	ref, err := p.getRef(ctx, string(v))
+	// Repositories that never left the default layout don't record it.
+	if layout != repo.LayoutObjects || next.Layout != "" {
+		next.Layout = layout
+	}
+
+	lfsObjects, err := p.pendingLFS()
 	if err != nil {
 		return nil, err
 	}
-	out = append(out, refPath{
-		path.Join(pth, string(v)),
-		RefPathHead,
-		string(ref),
+
+	for oid, c := range lfsObjects {
+		next.LFS[oid] = c
+	}
+
+	next.Head = p.nextHead(next.Refs, current.Head, updates)
+	if next.Chunking, err = p.chunking(ctx); err != nil {
+		return nil, err
+	}
+
+	return next, nil
+}
+
+// Rollback drops the ref updates staged during the current batch, along
+// with the large objects, packs and LFS uploads stored for them. A dry run
+// leaves the LFS uploads to the real push.
+func (p *Pfg) Rollback() {
+	p.updates = nil
+	p.dropStaged()
+
+	if p.options.DryRun {
+		return
+	}
+
+	err := p.updatePendingLFS(context.Background(), func(pending map[string]cid.Cid) {
+		for oid := range pending {
+			delete(pending, oid)
+		}
 	})
+	if err != nil {
+		log.Warn().Err(err).Msg("drop pending lfs objects")
+	}
+}
 
-	return out, nil
+// dropStaged forgets the large objects and packs stored for the current
+// batch, so no later root refers to them.
+func (p *Pfg) dropStaged() {
+	p.objects = map[string]cid.Cid{}
+	p.packs = nil
+	p.packed = map[plumbing.Hash]struct{}{}
 }
-func (p *Pfg) fillMissingLobjs(tracker *core.Tracker) error {
-	if p.largeObjs == nil {
-		if err := p.loadObjectMap(); err != nil {
-			return err
+
+// Root returns the CID of the latest root of the repository, cid.Undef
+// while it has never been pushed to.
+func (p *Pfg) Root() cid.Cid {
+	return p.rootCid
+}
+
+// nextHead returns what HEAD points at once updates are applied to refs.
+// HEAD is kept unless its branch is gone, in which case it moves to a
+// default branch, else to the first remaining branch, or nowhere when no
+// branch is left.
+func (p *Pfg) nextHead(refs repo.Refs, head string, updates []refUpdate) string {
+	if head == "" {
+		return p.initialHead(refs, updates)
+	}
+
+	if _, ok := refs[head]; ok {
+		return head
+	}
+
+	for _, branch := range append([]string{p.config.DefaultBranchRef()}, defaultBranches...) {
+		if _, ok := refs[branch]; ok {
+			return branch
+		}
+	}
+
+	if branches := refs.Names(BranchPrefix); len(branches) > 0 {
+		return branches[0]
+	}
+
+	return ""
+}
+
+// initialHead picks the branch HEAD points at once a repository gets its
+// first refs: the configured default branch when it was pushed, otherwise
+// the first branch of the batch.
+func (p *Pfg) initialHead(refs repo.Refs, updates []refUpdate) string {
+	if branch := p.config.DefaultBranchRef(); branch != "" {
+		if _, ok := refs[branch]; ok {
+			return branch
+		}
+	}
+
+	for _, u := range updates {
+		if u.hash != "" && strings.HasPrefix(u.ref, BranchPrefix) {
+			return u.ref
 		}
 	}
 
-	tracked, err := tracker.ListPrefixed(LObjTrackerPrefix)
+	return ""
+}
+
+// SetHead points the remote HEAD at ref, which must exist on the remote,
+// storing the change as a new root.
+func (p *Pfg) SetHead(ctx context.Context, ref string) error {
+	current, err := p.loadRoot(ctx)
 	if err != nil {
 		return err
 	}
 
-	for k, v := range tracked {
-		if _, has := p.largeObjs[k]; has {
-			continue
-		}
+	if _, ok := current.Refs[ref]; !ok {
+		return &gitremote.RefError{Ref: ref, Err: gitremote.ErrRefNotFound}
+	}
+
+	if current.Head == ref {
+		return nil
+	}
 
-		k = strings.TrimPrefix(k, LObjTrackerPrefix+"/")
+	next := current.Next(p.rootCid)
+	next.Head = ref
 
-		p.largeObjs[k] = v
-		//p.currentHash, err = p.api.PatchLink(p.currentHash, "objects/"+k, v, true)
-		//if err != nil {
-		//	return err
-		//}
+	return p.storeRoot(ctx, next)
+}
+
+func (p *Pfg) storeRoot(ctx context.Context, root *repo.Root) error {
+	if err := p.checkOwner(); err != nil {
+		return err
+	}
+
+	c, err := repo.StoreRoot(ctx, p.linkSys, root)
+	if err != nil {
+		return err
 	}
 
+	log.Debug().Msgf("stored root %s (parent %s)", c, root.Parent)
+	p.root, p.rootCid = root, c
+
 	return nil
 }
 
-func isNoLink(err error) bool {
-	return strings.Contains(err.Error(), "no link named") || strings.Contains(err.Error(), "no link by that name")
+// gitHash returns the git hash of the object core identifies by the CID
+// of its git-raw block.
+func gitHash(identifier string) (string, error) {
+	c, err := cid.Decode(identifier)
+	if err != nil {
+		return "", err
+	}
+
+	return core.HexFromCid(c)
+}
+
+// remoteRefs returns the refs of the latest root.
+func (p *Pfg) remoteRefs(ctx context.Context) (repo.Refs, error) {
+	root, err := p.loadRoot(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return root.Refs, nil
+}
+
+// loadRoot loads the root the remote URL points at, or an empty one for
+// remotes that were never pushed to. A name that doesn't resolve is an
+// error unless the session pushes to it.
+func (p *Pfg) loadRoot(ctx context.Context) (*repo.Root, error) {
+	if p.root != nil {
+		return p.root, nil
+	}
+
+	c, err := p.resolveRoot()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Defined() {
+		root, err := repo.LoadRoot(ctx, p.linkSys, c)
+		if err != nil {
+			return nil, fmt.Errorf("load repository root %s: %w", c, err)
+		}
+
+		p.root, p.rootCid, p.baseCid = root, c, c
+
+		return root, nil
+	}
+
+	if p.name != nil && !p.pushing {
+		return nil, fmt.Errorf("%w: %s", naming.ErrNameNotFound, p.name)
+	}
+
+	p.root = repo.NewRoot()
+
+	return p.root, nil
+}
+
+// resolveRoot returns the CID of the root the remote refers to, directly
+// or through its name, or cid.Undef when there is none.
+func (p *Pfg) resolveRoot() (cid.Cid, error) {
+	if p.name != nil {
+		c, err := p.resolver.Resolve(*p.name)
+		if errors.Is(err, naming.ErrNameNotFound) {
+			return cid.Undef, nil
+		}
+
+		return c, err
+	}
+
+	if p.remoteName == "" || p.remoteName == EmptyRepo {
+		return cid.Undef, nil
+	}
+
+	if c, err := cid.Decode(p.remoteName); err == nil && c.Type() == cid.DagCBOR {
+		return c, nil
+	}
+
+	return cid.Undef, fmt.Errorf("remote %q: %w", p.remoteName, ErrUnknownRemote)
+}
+
+// checkOwner makes sure the local identity can publish the name of the
+// repository, before any root that would need publishing is stored.
+func (p *Pfg) checkOwner() error {
+	if p.name == nil || p.identity != nil {
+		return nil
+	}
+
+	key, err := p.resolver.Identity()
+	if err != nil {
+		return err
+	}
+
+	if !p.name.Owner.MatchesPrivateKey(key) {
+		return fmt.Errorf("%w %s", naming.ErrNotOwner, p.name)
+	}
+
+	p.identity = key
+
+	return nil
 }
@@ -0,0 +1,98 @@
+package gitremotepfg
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/revlist"
+
+	"github.com/peerforge/peerforge/pkg/gitremote"
+	"github.com/peerforge/peerforge/pkg/repo"
+)
+
+// pushStats summarises the objects a push adds to the store.
+type pushStats struct {
+	objects int
+	large   int
+	bytes   int64
+}
+
+func (s *pushStats) add(size int64, large bool) {
+	s.objects++
+	s.bytes += size
+	if large {
+		s.large++
+	}
+}
+
+// pendingObjects lists the objects reachable from hash that aren't
+// reachable from any of haves, i.e. what a push of hash has to upload.
+// Haves missing from the local repository are ignored.
+func (p *Pfg) pendingObjects(hash plumbing.Hash, haves []plumbing.Hash) ([]plumbing.Hash, error) {
+	return revlist.Objects(p.repo.Storer, []plumbing.Hash{hash}, haves)
+}
+
+// remoteHaves returns the tips of every remote ref, which a push can
+// assume the store already has.
+func (p *Pfg) remoteHaves(ctx context.Context) ([]plumbing.Hash, error) {
+	refs, err := p.remoteRefs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	haves := make([]plumbing.Hash, 0, len(refs))
+	for _, name := range refs.Names() {
+		haves = append(haves, plumbing.NewHash(refs[name]))
+	}
+
+	return haves, nil
+}
+
+// reportDryRun tells what pushing hash to remote, over old, added to the
+// store during a dry run.
+func (p *Pfg) reportDryRun(remote string, old string, hash plumbing.Hash, stats pushStats) {
+	from := plumbing.ZeroHash
+	if old != "" {
+		from = plumbing.NewHash(old)
+	}
+
+	_, _ = fmt.Fprintf(
+		p.stderr,
+		"dry-run: %s %s..%s would add %d objects (%d large), %s\n",
+		remote,
+		from.String()[:7],
+		hash.String()[:7],
+		stats.objects,
+		stats.large,
+		gitremote.FormatBytes(stats.bytes),
+	)
+}
+
+// dryRunCommit reports the ref updates of a dry run and the root they would
+// be stored in, whose CID is computed without storing anything. What the
+// batch staged is dropped.
+func (p *Pfg) dryRunCommit(ctx context.Context, next *repo.Root, updates []refUpdate) error {
+	defer p.dropStaged()
+
+	if err := p.checkOwner(); err != nil {
+		return err
+	}
+
+	c, err := repo.StoreRoot(ctx, p.storeLinkSys(), next)
+	if err != nil {
+		return err
+	}
+
+	for _, u := range updates {
+		if u.hash == "" {
+			_, _ = fmt.Fprintf(p.stderr, "dry-run: %s would be deleted\n", u.ref)
+		} else {
+			_, _ = fmt.Fprintf(p.stderr, "dry-run: %s would point at %s\n", u.ref, u.hash)
+		}
+	}
+
+	_, _ = fmt.Fprintf(p.stderr, "dry-run: %s would be at pfg://%s\n", p.remoteLabel(), c)
+
+	return nil
+}
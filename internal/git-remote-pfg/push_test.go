@@ -0,0 +1,508 @@
+package gitremotepfg
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/drgomesp/git-remote-ipldprime/core"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/storage/memstore"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/peerforge/peerforge/pkg/config"
+	"github.com/peerforge/peerforge/pkg/gitfmt"
+	"github.com/peerforge/peerforge/pkg/gitremote"
+	"github.com/peerforge/peerforge/pkg/naming"
+	"github.com/peerforge/peerforge/pkg/repo"
+)
+
+// syncStore makes a memstore.Store safe for the concurrent writes of
+// pushes.
+type syncStore struct {
+	mu sync.Mutex
+	st *memstore.Store
+}
+
+func (s *syncStore) Has(ctx context.Context, key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.st.Has(ctx, key)
+}
+
+func (s *syncStore) Get(ctx context.Context, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.st.Get(ctx, key)
+}
+
+func (s *syncStore) Put(ctx context.Context, key string, content []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.st.Put(ctx, key, content)
+}
+
+// newTestPfg returns a handler for a new local repository, pushing to a
+// store held in memory. Its messages go to the returned buffer.
+func newTestPfg(t *testing.T) (*Pfg, *memstore.Store, *bytes.Buffer) {
+	dir := t.TempDir()
+
+	r, err := git.PlainInit(dir, false)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	t.Setenv("GIT_DIR", filepath.Join(dir, git.GitDirName))
+
+	tracker, err := core.NewTracker()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	st := &memstore.Store{}
+	store := &syncStore{st: st}
+	ls := cidlink.DefaultLinkSystem()
+	ls.SetReadStorage(store)
+	ls.SetWriteStorage(store)
+
+	var stderr bytes.Buffer
+
+	return &Pfg{
+		linkSys:  &ls,
+		repo:     r,
+		store:    store,
+		tracker:  tracker,
+		options:  gitremote.NewOptions(),
+		config:   &config.Config{},
+		stderr:   &stderr,
+		objects:  map[string]cid.Cid{},
+		packed:   map[plumbing.Hash]struct{}{},
+		localDir: dir,
+		resolver: naming.NewResolver(t.TempDir()),
+	}, st, &stderr
+}
+
+// commitFile commits content as name on the current branch of r.
+func commitFile(t *testing.T, r *git.Repository, name string, content []byte) plumbing.Hash {
+	w, err := r.Worktree()
+	assert.NoError(t, err)
+
+	assert.NoError(t, util.WriteFile(w.Filesystem, name, content, 0644))
+	_, err = w.Add(name)
+	assert.NoError(t, err)
+
+	sig := &object.Signature{Name: "a", Email: "a@example.com", When: time.Unix(0, 0).UTC()}
+	h, err := w.Commit("add "+name, &git.CommitOptions{Author: sig, Committer: sig})
+	assert.NoError(t, err)
+
+	return h
+}
+
+func TestPfg_DryRun(t *testing.T) {
+	for _, layout := range []string{repo.LayoutObjects, repo.LayoutPacks} {
+		t.Run(layout, func(t *testing.T) {
+			p, st, stderr := newTestPfg(t)
+			p.config.LargeObjectThreshold = 64
+			p.config.Layout = layout
+			ctx := context.Background()
+
+			commitFile(t, p.repo, "small.txt", []byte("hello\n"))
+			tip := commitFile(t, p.repo, "large.bin", bytes.Repeat([]byte("large "), 100))
+
+			p.options.DryRun = true
+			_, err := p.Push(ctx, "refs/heads/master", "refs/heads/main", false)
+			assert.NoError(t, err)
+			assert.NoError(t, p.Commit(ctx))
+
+			assert.Equal(t, cid.Undef, p.Root(), "a dry run stores no root")
+			assert.Empty(t, st.Bag, "a dry run stores nothing")
+			assert.Empty(t, p.objects)
+			assert.Contains(t, stderr.String(), "dry-run: refs/heads/main would point at "+tip.String())
+
+			p.options.DryRun = false
+			_, err = p.Push(ctx, "refs/heads/master", "refs/heads/main", false)
+			assert.NoError(t, err)
+			assert.NoError(t, p.Commit(ctx))
+
+			assert.True(t, p.Root().Defined())
+			assert.Contains(t, stderr.String(), "would be at pfg://"+p.Root().String()+"\n", "the dry run reported the root of the push")
+
+			stderr.Reset()
+			p.options.DryRun = true
+			_, err = p.Push(ctx, "refs/heads/master", "refs/heads/main", false)
+			assert.NoError(t, err)
+			assert.NoError(t, p.Commit(ctx))
+			assert.Contains(t, stderr.String(), "would add 0 objects (0 large)", "the remote has everything")
+		})
+	}
+}
+
+func TestPfg_DryRunStoredObjects(t *testing.T) {
+	p, _, stderr := newTestPfg(t)
+	p.config.LargeObjectThreshold = 64
+	ctx := context.Background()
+
+	commitFile(t, p.repo, "small.txt", []byte("hello\n"))
+	commitFile(t, p.repo, "large.bin", bytes.Repeat([]byte("large "), 100))
+
+	_, err := p.Push(ctx, "refs/heads/master", "refs/heads/main", false)
+	assert.NoError(t, err)
+	assert.NoError(t, p.Commit(ctx))
+	assert.NoError(t, p.Delete(ctx, "refs/heads/main"))
+	assert.NoError(t, p.Commit(ctx))
+
+	// No ref leads to the objects anymore, but the store still has them.
+	p.options.DryRun = true
+	_, err = p.Push(ctx, "refs/heads/master", "refs/heads/main", false)
+	assert.NoError(t, err)
+	assert.Contains(t, stderr.String(), "would add 0 objects (0 large)")
+}
+
+func TestPfg_Rollback(t *testing.T) {
+	p, _, _ := newTestPfg(t)
+	p.config.LargeObjectThreshold = 64
+	ctx := context.Background()
+
+	commitFile(t, p.repo, "large.bin", bytes.Repeat([]byte("large "), 100))
+
+	lfsObject := filepath.Join(t.TempDir(), "object")
+	assert.NoError(t, os.WriteFile(lfsObject, []byte("lfs\n"), 0644))
+	assert.NoError(t, p.Upload(ctx, "64fc7da9eafea5e011f98d6cce8340fd7e812ce81a92259413d2f8b527c84f8c", lfsObject))
+
+	_, err := p.Push(ctx, "refs/heads/master", "refs/heads/main", false)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, p.objects)
+
+	p.Rollback()
+	assert.Empty(t, p.objects)
+
+	pending, err := p.pendingLFS()
+	assert.NoError(t, err)
+	assert.Empty(t, pending)
+
+	commitFile(t, p.repo, "small.txt", []byte("hello\n"))
+	_, err = p.Push(ctx, "refs/heads/master", "refs/heads/next", false)
+	assert.NoError(t, err)
+	assert.NoError(t, p.Commit(ctx))
+
+	root, err := p.loadRoot(ctx)
+	assert.NoError(t, err)
+	assert.NotContains(t, root.Refs, "refs/heads/main")
+	assert.Empty(t, root.LFS, "nothing of the rolled back batch makes it into the root")
+}
+
+func TestPfg_UploadConcurrent(t *testing.T) {
+	p, _, _ := newTestPfg(t)
+	p.config.LargeObjectThreshold = 64
+	p.config.PushConcurrency = 8
+	ctx := context.Background()
+
+	for i := 0; i < 20; i++ {
+		commitFile(t, p.repo, fmt.Sprintf("file%d.txt", i), bytes.Repeat([]byte{byte('a' + i)}, i*10))
+	}
+
+	_, err := p.Push(ctx, "refs/heads/master", "refs/heads/main", false)
+	assert.NoError(t, err)
+	assert.NoError(t, p.Commit(ctx))
+
+	iter, err := p.repo.Storer.IterEncodedObjects(plumbing.AnyObject)
+	assert.NoError(t, err)
+
+	assert.NoError(t, iter.ForEach(func(obj plumbing.EncodedObject) error {
+		want, err := looseObject(obj)
+		assert.NoError(t, err)
+
+		got, err := p.Object(ctx, obj.Hash().String())
+		assert.NoError(t, err, obj.Hash().String())
+		assert.Equal(t, want, got, obj.Hash().String())
+
+		return nil
+	}))
+}
+
+func TestPfg_PackLayout(t *testing.T) {
+	p, _, _ := newTestPfg(t)
+	p.config.Layout = repo.LayoutPacks
+	ctx := context.Background()
+
+	commitFile(t, p.repo, "a.txt", []byte("a\n"))
+	commitFile(t, p.repo, "b.txt", bytes.Repeat([]byte("b"), 1000))
+
+	_, err := p.Push(ctx, "refs/heads/master", "refs/heads/main", false)
+	assert.NoError(t, err)
+	assert.NoError(t, p.Commit(ctx))
+
+	// Start over from the pushed root, without the pack indexes of the
+	// push cached.
+	p.remoteName = p.Root().String()
+	p.root, p.packIndexes = nil, nil
+
+	packs, err := p.Packs(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, packs, 1)
+
+	loaded, err := p.loadRoot(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, repo.LayoutPacks, loaded.Layout)
+	assert.Empty(t, loaded.Objects)
+
+	pack, err := p.Pack(ctx, packs[0])
+	assert.NoError(t, err)
+	data, err := io.ReadAll(pack)
+	assert.NoError(t, err)
+	assert.NoError(t, pack.Close())
+	assert.Equal(t, []byte("PACK"), data[:4])
+
+	iter, err := p.repo.Storer.IterEncodedObjects(plumbing.AnyObject)
+	assert.NoError(t, err)
+
+	var n int
+	assert.NoError(t, iter.ForEach(func(obj plumbing.EncodedObject) error {
+		n++
+
+		want, err := looseObject(obj)
+		assert.NoError(t, err)
+
+		got, err := p.Object(ctx, obj.Hash().String())
+		assert.NoError(t, err, "through the pack index")
+		assert.Equal(t, want, got, obj.Hash().String())
+
+		return nil
+	}))
+	assert.Equal(t, 6, n, "2 commits, 2 trees and 2 blobs")
+
+	_, err = p.Object(ctx, plumbing.ComputeHash(plumbing.BlobObject, []byte("missing")).String())
+	assert.ErrorIs(t, err, plumbing.ErrObjectNotFound)
+}
+
+func TestPfg_UnknownLayout(t *testing.T) {
+	p, _, _ := newTestPfg(t)
+	p.config.Layout = "tarballs"
+
+	commitFile(t, p.repo, "a.txt", []byte("a\n"))
+
+	_, err := p.Push(context.Background(), "refs/heads/master", "refs/heads/main", false)
+	assert.ErrorContains(t, err, `unknown layout "tarballs"`)
+}
+
+func TestPfg_PushFastForward(t *testing.T) {
+	tests := []struct {
+		name string
+		// old is the tip of the remote ref, given the local commits.
+		old     func(first, second plumbing.Hash) plumbing.Hash
+		local   func(first, second plumbing.Hash) plumbing.Hash
+		force   bool
+		wantErr error
+	}{
+		{
+			name:  "fast-forward",
+			old:   func(first, _ plumbing.Hash) plumbing.Hash { return first },
+			local: func(_, second plumbing.Hash) plumbing.Hash { return second },
+		},
+		{
+			name:    "non-fast-forward",
+			old:     func(_, second plumbing.Hash) plumbing.Hash { return second },
+			local:   func(first, _ plumbing.Hash) plumbing.Hash { return first },
+			wantErr: gitremote.ErrNonFastForward,
+		},
+		{
+			name:  "forced non-fast-forward",
+			old:   func(_, second plumbing.Hash) plumbing.Hash { return second },
+			local: func(first, _ plumbing.Hash) plumbing.Hash { return first },
+			force: true,
+		},
+		{
+			name: "old tip missing locally",
+			old: func(_, _ plumbing.Hash) plumbing.Hash {
+				return plumbing.NewHash("1111111111111111111111111111111111111111")
+			},
+			local:   func(_, second plumbing.Hash) plumbing.Hash { return second },
+			wantErr: gitremote.ErrNonFastForward,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _, _ := newTestPfg(t)
+			ctx := context.Background()
+
+			first := commitFile(t, p.repo, "a.txt", []byte("a\n"))
+			second := commitFile(t, p.repo, "b.txt", []byte("b\n"))
+
+			p.root = repo.NewRoot()
+			p.root.Refs["refs/heads/main"] = tt.old(first, second).String()
+
+			local := tt.local(first, second)
+			assert.NoError(t, p.repo.Storer.SetReference(plumbing.NewHashReference("refs/heads/topic", local)))
+
+			_, err := p.Push(ctx, "refs/heads/topic", "refs/heads/main", tt.force)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+
+				var refErr *gitremote.RefError
+				if assert.ErrorAs(t, err, &refErr) {
+					assert.Equal(t, "refs/heads/main", refErr.Ref)
+				}
+				assert.Empty(t, p.updates, "a rejected push stages nothing")
+
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.NoError(t, p.Commit(ctx))
+
+			root, err := p.loadRoot(ctx)
+			assert.NoError(t, err)
+			assert.Equal(t, local.String(), root.Refs["refs/heads/main"])
+		})
+	}
+}
+
+func TestPfg_Delete(t *testing.T) {
+	tests := []struct {
+		name     string
+		branches []string
+		delete   []string
+		wantHead string
+	}{
+		{
+			name:     "other branch",
+			branches: []string{"refs/heads/main", "refs/heads/topic"},
+			delete:   []string{"refs/heads/topic"},
+			wantHead: "refs/heads/main",
+		},
+		{
+			name:     "head to a default branch",
+			branches: []string{"refs/heads/main", "refs/heads/master", "refs/heads/topic"},
+			delete:   []string{"refs/heads/main"},
+			wantHead: "refs/heads/master",
+		},
+		{
+			name:     "head to a remaining branch",
+			branches: []string{"refs/heads/main", "refs/heads/topic", "refs/heads/feature"},
+			delete:   []string{"refs/heads/main"},
+			wantHead: "refs/heads/feature",
+		},
+		{
+			name:     "every branch",
+			branches: []string{"refs/heads/main", "refs/heads/topic"},
+			delete:   []string{"refs/heads/main", "refs/heads/topic"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _, _ := newTestPfg(t)
+			ctx := context.Background()
+
+			commitFile(t, p.repo, "a.txt", []byte("a\n"))
+			for _, branch := range tt.branches {
+				_, err := p.Push(ctx, "refs/heads/master", branch, false)
+				assert.NoError(t, err)
+			}
+			assert.NoError(t, p.Commit(ctx))
+
+			root, err := p.loadRoot(ctx)
+			assert.NoError(t, err)
+			assert.Equal(t, "refs/heads/main", root.Head)
+
+			for _, branch := range tt.delete {
+				assert.NoError(t, p.Delete(ctx, branch))
+			}
+			assert.NoError(t, p.Commit(ctx))
+
+			root, err = p.loadRoot(ctx)
+			assert.NoError(t, err)
+			for _, branch := range tt.delete {
+				assert.NotContains(t, root.Refs, branch)
+			}
+			assert.Len(t, root.Refs, len(tt.branches)-len(tt.delete))
+			assert.Equal(t, tt.wantHead, root.Head)
+		})
+	}
+}
+
+func TestPfg_DeleteMissing(t *testing.T) {
+	p, _, _ := newTestPfg(t)
+
+	err := p.Delete(context.Background(), "refs/heads/main")
+	assert.ErrorIs(t, err, gitremote.ErrRefNotFound)
+	assert.Empty(t, p.updates)
+}
+
+func TestPfg_RollbackDryRun(t *testing.T) {
+	p, _, _ := newTestPfg(t)
+	ctx := context.Background()
+
+	lfsObject := filepath.Join(t.TempDir(), "object")
+	assert.NoError(t, os.WriteFile(lfsObject, []byte("lfs\n"), 0644))
+	assert.NoError(t, p.Upload(ctx, "64fc7da9eafea5e011f98d6cce8340fd7e812ce81a92259413d2f8b527c84f8c", lfsObject))
+
+	commitFile(t, p.repo, "small.txt", []byte("hello\n"))
+
+	p.options.DryRun = true
+	_, err := p.Push(ctx, "refs/heads/master", "refs/heads/main", false)
+	assert.NoError(t, err)
+	p.Rollback()
+
+	pending, err := p.pendingLFS()
+	assert.NoError(t, err)
+	assert.Contains(t, pending, "64fc7da9eafea5e011f98d6cce8340fd7e812ce81a92259413d2f8b527c84f8c", "a dry run changes nothing locally")
+}
+
+func TestPfg_PushTags(t *testing.T) {
+	p, _, _ := newTestPfg(t)
+	ctx := context.Background()
+
+	first := commitFile(t, p.repo, "a.txt", []byte("a\n"))
+	sig := &object.Signature{Name: "a", Email: "a@example.com", When: time.Unix(0, 0).UTC()}
+
+	annotated, err := p.repo.CreateTag("v1", first, &git.CreateTagOptions{Tagger: sig, Message: "v1"})
+	assert.NoError(t, err)
+	_, err = p.repo.CreateTag("light", first, nil)
+	assert.NoError(t, err)
+
+	for _, tag := range []string{"refs/tags/v1", "refs/tags/light"} {
+		_, err = p.Push(ctx, tag, tag, false)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, p.Commit(ctx))
+
+	refs, err := p.List(false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		first.String() + " refs/tags/light",
+		annotated.Hash().String() + " refs/tags/v1",
+		first.String() + " refs/tags/v1" + gitfmt.PeeledSuffix,
+	}, refs)
+
+	second := commitFile(t, p.repo, "b.txt", []byte("b\n"))
+	assert.NoError(t, p.repo.DeleteTag("light"))
+	_, err = p.repo.CreateTag("light", second, nil)
+	assert.NoError(t, err)
+
+	_, err = p.Push(ctx, "refs/tags/light", "refs/tags/light", false)
+	assert.ErrorIs(t, err, gitremote.ErrAlreadyExists, "tags don't move, even by fast-forward")
+
+	_, err = p.Push(ctx, "refs/tags/light", "refs/tags/light", true)
+	assert.NoError(t, err)
+	assert.NoError(t, p.Commit(ctx))
+
+	root, err := p.loadRoot(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, second.String(), root.Refs["refs/tags/light"])
+}
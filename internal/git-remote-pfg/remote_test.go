@@ -0,0 +1,309 @@
+package gitremotepfg
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"strconv"
+	"testing"
+
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/peerforge/peerforge/pkg/gitremote"
+	"github.com/peerforge/peerforge/pkg/naming"
+)
+
+func TestPfg_Finish(t *testing.T) {
+	tests := []struct {
+		name  string
+		alias string
+		url   string
+		moved bool
+	}{
+		{name: "new remote", alias: "origin", url: URLScheme, moved: true},
+		{name: "bare url", alias: "", url: URLScheme},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _, stderr := newTestPfg(t)
+			p.alias = tt.alias
+			ctx := context.Background()
+
+			_, err := p.repo.CreateRemote(&gitconfig.RemoteConfig{Name: "origin", URLs: []string{tt.url}})
+			assert.NoError(t, err)
+
+			commitFile(t, p.repo, "hello.txt", []byte("hello\n"))
+			_, err = p.Push(ctx, "refs/heads/master", "refs/heads/main", false)
+			assert.NoError(t, err)
+			assert.NoError(t, p.Commit(ctx))
+			assert.NoError(t, p.Finish())
+
+			cfg, err := p.repo.Config()
+			assert.NoError(t, err)
+
+			want := tt.url
+			if tt.moved {
+				want = URLScheme + p.Root().String()
+			}
+			assert.Equal(t, []string{want}, cfg.Remotes["origin"].URLs)
+			assert.Contains(t, stderr.String(), "is now at "+URLScheme+p.Root().String())
+		})
+	}
+}
+
+func TestPfg_FinishUnchanged(t *testing.T) {
+	p, _, stderr := newTestPfg(t)
+	p.alias = "origin"
+
+	_, err := p.repo.CreateRemote(&gitconfig.RemoteConfig{Name: "origin", URLs: []string{URLScheme}})
+	assert.NoError(t, err)
+
+	assert.NoError(t, p.Finish())
+
+	cfg, err := p.repo.Config()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{URLScheme}, cfg.Remotes["origin"].URLs, "nothing was pushed")
+	assert.Empty(t, stderr.String())
+}
+
+func TestPfg_LoadRootUnpublishedName(t *testing.T) {
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	assert.NoError(t, err)
+	id, err := peer.IDFromPrivateKey(key)
+	assert.NoError(t, err)
+	name, err := naming.ParseName(id.String() + "/repo")
+	assert.NoError(t, err)
+
+	p, _, _ := newTestPfg(t)
+	p.name = &name
+
+	_, err = p.List(false)
+	assert.ErrorIs(t, err, naming.ErrNameNotFound, "fetching a name nobody published")
+
+	refs, err := p.List(true)
+	assert.NoError(t, err, "pushing creates the name")
+	assert.Empty(t, refs)
+}
+
+func TestPfg_LargeObject(t *testing.T) {
+	p, st, _ := newTestPfg(t)
+	p.config.LargeObjectThreshold = 64
+	p.config.ChunkSize = 1024
+	ctx := context.Background()
+
+	content := bytes.Repeat([]byte("large "), 1000)
+	commitFile(t, p.repo, "large.bin", content)
+
+	_, err := p.Push(ctx, "refs/heads/master", "refs/heads/main", false)
+	assert.NoError(t, err)
+	assert.NoError(t, p.Commit(ctx))
+
+	blob := plumbing.ComputeHash(plumbing.BlobObject, content)
+	want := append([]byte(fmt.Sprintf("blob %d\x00", len(content))), content...)
+
+	root, err := p.loadRoot(ctx)
+	assert.NoError(t, err)
+	assert.Contains(t, root.Objects, blob.String(), "the blob is stored as a blobdag")
+
+	c, err := gitremote.CidFromHex(blob.String())
+	assert.NoError(t, err)
+	assert.NotContains(t, st.Bag, string(cidlink.Link{Cid: c}.Binary()), "not as a single block")
+
+	got, err := p.Object(ctx, blob.String())
+	assert.NoError(t, err)
+	assert.Equal(t, want, got)
+
+	got, err = p.ProvideBlock(c.String(), p.tracker)
+	assert.NoError(t, err)
+	assert.Equal(t, want, got)
+
+	size, err := p.ObjectSize(ctx, blob.String())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(content)), size)
+}
+
+func TestBlobSize(t *testing.T) {
+	tests := []struct {
+		size int
+	}{
+		{size: 0},
+		{size: 9},
+		{size: 10},
+		{size: 99},
+		{size: 100},
+		{size: 1 << 20},
+	}
+
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.size), func(t *testing.T) {
+			loose := len(fmt.Sprintf("blob %d\x00", tt.size)) + tt.size
+			assert.Equal(t, int64(tt.size), blobSize(int64(loose)))
+		})
+	}
+}
+
+func TestPfg_ListForPush(t *testing.T) {
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	assert.NoError(t, err)
+	id, err := peer.IDFromPrivateKey(key)
+	assert.NoError(t, err)
+	name, err := naming.ParseName(id.String() + "/repo")
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name string
+		// remote is the name the remote URL gives, if any.
+		remote *naming.Name
+		pushed bool
+	}{
+		{name: "empty remote"},
+		{name: "unpublished name", remote: &name},
+		{name: "existing remote", pushed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _, _ := newTestPfg(t)
+			p.name = tt.remote
+			ctx := context.Background()
+
+			tip := commitFile(t, p.repo, "a.txt", []byte("a\n"))
+
+			want := []string{}
+			if tt.pushed {
+				_, err := p.Push(ctx, "refs/heads/master", "refs/heads/main", false)
+				assert.NoError(t, err)
+				assert.NoError(t, p.Commit(ctx))
+
+				// Start over from the pushed root.
+				p.remoteName, p.root = p.Root().String(), nil
+				want = []string{"@refs/heads/main HEAD", tip.String() + " refs/heads/main"}
+			}
+
+			refs, err := p.List(true)
+			assert.NoError(t, err)
+			assert.Equal(t, want, refs)
+		})
+	}
+}
+
+func TestPfg_InitialHead(t *testing.T) {
+	tests := []struct {
+		name          string
+		defaultBranch string
+		refs          []string
+		want          string
+	}{
+		{name: "first branch of the batch", refs: []string{"refs/tags/v1", "refs/heads/topic", "refs/heads/main"}, want: "refs/heads/topic"},
+		{name: "configured default branch", defaultBranch: "main", refs: []string{"refs/heads/topic", "refs/heads/main"}, want: "refs/heads/main"},
+		{name: "default branch not pushed", defaultBranch: "trunk", refs: []string{"refs/heads/topic"}, want: "refs/heads/topic"},
+		{name: "tags only", refs: []string{"refs/tags/v1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _, _ := newTestPfg(t)
+			p.config.DefaultBranch = tt.defaultBranch
+			ctx := context.Background()
+
+			tip := commitFile(t, p.repo, "a.txt", []byte("a\n"))
+			assert.NoError(t, p.repo.Storer.SetReference(plumbing.NewHashReference("refs/tags/v1", tip)))
+
+			for _, ref := range tt.refs {
+				local := "refs/heads/master"
+				if ref == "refs/tags/v1" {
+					local = ref
+				}
+
+				_, err := p.Push(ctx, local, ref, false)
+				assert.NoError(t, err)
+			}
+			assert.NoError(t, p.Commit(ctx))
+
+			root, err := p.loadRoot(ctx)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, root.Head)
+		})
+	}
+}
+
+func TestPfg_SetHead(t *testing.T) {
+	p, _, _ := newTestPfg(t)
+	ctx := context.Background()
+
+	commitFile(t, p.repo, "a.txt", []byte("a\n"))
+	for _, ref := range []string{"refs/heads/main", "refs/heads/trunk"} {
+		_, err := p.Push(ctx, "refs/heads/master", ref, false)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, p.Commit(ctx))
+	pushed := p.Root()
+
+	assert.ErrorIs(t, p.SetHead(ctx, "refs/heads/missing"), gitremote.ErrRefNotFound)
+	assert.Equal(t, pushed, p.Root())
+
+	assert.NoError(t, p.SetHead(ctx, "refs/heads/main"))
+	assert.Equal(t, pushed, p.Root(), "HEAD is there already")
+
+	assert.NoError(t, p.SetHead(ctx, "refs/heads/trunk"))
+	assert.NotEqual(t, pushed, p.Root())
+
+	root, err := p.loadRoot(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "refs/heads/trunk", root.Head)
+	assert.Equal(t, pushed, root.Parent)
+
+	refs, err := p.List(false)
+	assert.NoError(t, err)
+	assert.Equal(t, "@refs/heads/trunk HEAD", refs[0])
+}
+
+func TestPfg_LoadRootRemoteName(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteName func(root cid.Cid) string
+		wantErr    error
+		wantRefs   int
+	}{
+		{name: "bare url", remoteName: func(cid.Cid) string { return "" }},
+		{name: "empty repository", remoteName: func(cid.Cid) string { return EmptyRepo }},
+		{name: "root", remoteName: func(root cid.Cid) string { return root.String() }, wantRefs: 1},
+		{
+			name:       "pre-root storage format",
+			remoteName: func(cid.Cid) string { return "QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG" },
+			wantErr:    ErrUnknownRemote,
+		},
+		{name: "mistyped root", remoteName: func(root cid.Cid) string { return root.String()[1:] }, wantErr: ErrUnknownRemote},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _, _ := newTestPfg(t)
+			ctx := context.Background()
+
+			commitFile(t, p.repo, "a.txt", []byte("a\n"))
+			_, err := p.Push(ctx, "refs/heads/master", "refs/heads/main", false)
+			assert.NoError(t, err)
+			assert.NoError(t, p.Commit(ctx))
+
+			p.remoteName, p.root = tt.remoteName(p.Root()), nil
+
+			root, err := p.loadRoot(ctx)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Len(t, root.Refs, tt.wantRefs)
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package gitremotepfg
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/rs/zerolog/log"
+
+	"github.com/peerforge/peerforge/pkg/blobdag"
+	"github.com/peerforge/peerforge/pkg/gitremote"
+	"github.com/peerforge/peerforge/pkg/repo"
+)
+
+// upload stores hashes with a bounded pool of workers, each encoding and
+// writing one object at a time. Objects above the chunking threshold go
+// to blobdags indexed in p.objects, unless the root indexes them already,
+// the others to the object store under their git hash, skipping those it
+// already has. The returned stats only count the objects stored.
+//
+// Objects are stored in no particular order. That is fine since nothing
+// refers to them until Commit stores a root, which only happens once the
+// whole push went through.
+func (p *Pfg) upload(ctx context.Context, hashes []plumbing.Hash, chunking repo.Chunking, progress *gitremote.Progress) (pushStats, error) {
+	root, err := p.loadRoot(ctx)
+	if err != nil {
+		return pushStats{}, err
+	}
+
+	ls := p.storeLinkSys()
+
+	// The go-git storer isn't documented as safe for concurrent use, so
+	// objects are looked up one at a time under storerMu. Reading their
+	// content, encoding and storing them runs in parallel, the object
+	// store being safe for concurrent use. mu guards p.objects and stats.
+	var (
+		storerMu sync.Mutex
+		mu       sync.Mutex
+		stats    pushStats
+	)
+
+	err = gitremote.ForEach(ctx, p.pushConcurrency(), len(hashes), func(ctx context.Context, i int) error {
+		h := hashes[i]
+
+		storerMu.Lock()
+		obj, err := p.repo.Storer.EncodedObject(plumbing.AnyObject, h)
+		storerMu.Unlock()
+		if err != nil {
+			return fmt.Errorf("object %s: %w", h, err)
+		}
+
+		raw, err := looseObject(obj)
+		if err != nil {
+			return fmt.Errorf("object %s: %w", h, err)
+		}
+
+		progress.Add(1, int64(len(raw)))
+
+		if int64(len(raw)) <= chunking.Threshold {
+			stored, err := p.storeObject(ctx, ls, h, raw)
+			if stored {
+				mu.Lock()
+				stats.add(int64(len(raw)), false)
+				mu.Unlock()
+			}
+
+			return err
+		}
+
+		// Large objects stored by earlier pushes are in the index of the
+		// root already.
+		if _, ok := root.Objects[h.String()]; ok {
+			return nil
+		}
+
+		log.Debug().Msgf("large object %s: %s", h, gitremote.FormatBytes(int64(len(raw))))
+
+		c, err := blobdag.Write(ctx, ls, raw, int(chunking.ChunkSize))
+		if err != nil {
+			return fmt.Errorf("large object %s: %w", h, err)
+		}
+
+		mu.Lock()
+		stats.add(int64(len(raw)), true)
+		p.objects[h.String()] = c
+		mu.Unlock()
+
+		return nil
+	})
+
+	return stats, err
+}
+
+// uploadPack stores hashes as a single packfile, with the index Object
+// reads them back through, to be added to the next root by Commit. Objects
+// already packed during the batch, for another ref, are left out.
+//
+// Objects are packed in hash order, so the same push always stores the
+// same pack.
+func (p *Pfg) uploadPack(ctx context.Context, hashes []plumbing.Hash, chunking repo.Chunking, progress *gitremote.Progress) (pushStats, error) {
+	if p.packed == nil {
+		p.packed = map[plumbing.Hash]struct{}{}
+	}
+
+	pending := make([]plumbing.Hash, 0, len(hashes))
+	for _, h := range hashes {
+		if _, ok := p.packed[h]; !ok {
+			pending = append(pending, h)
+		}
+	}
+
+	var stats pushStats
+	if len(pending) == 0 {
+		return stats, nil
+	}
+
+	sort.Slice(pending, func(i, j int) bool {
+		return bytes.Compare(pending[i][:], pending[j][:]) < 0
+	})
+
+	var buf bytes.Buffer
+	entries, err := repo.WritePack(&buf, pending, func(h plumbing.Hash) (plumbing.EncodedObject, error) {
+		obj, err := p.repo.Storer.EncodedObject(plumbing.AnyObject, h)
+		if err == nil {
+			progress.Add(1, obj.Size())
+			stats.add(obj.Size(), false)
+		}
+
+		return obj, err
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	c, err := repo.StorePack(ctx, p.storeLinkSys(), buf.Bytes(), entries, int(chunking.ChunkSize))
+	if err != nil {
+		return stats, err
+	}
+
+	log.Debug().Msgf("stored pack %s: %d objects, %s", c, len(entries), gitremote.FormatBytes(int64(buf.Len())))
+
+	p.packs = append(p.packs, c)
+	for _, h := range pending {
+		p.packed[h] = struct{}{}
+	}
+
+	return stats, nil
+}
+
+// storeLinkSys returns the LinkSystem pushes write through: the one of the
+// object store, or during a dry run one computing links without storing
+// anything.
+func (p *Pfg) storeLinkSys() *ipld.LinkSystem {
+	if !p.options.DryRun {
+		return p.linkSys
+	}
+
+	ls := cidlink.DefaultLinkSystem()
+	ls.StorageWriteOpener = func(ipld.LinkContext) (io.Writer, ipld.BlockWriteCommitter, error) {
+		return io.Discard, func(ipld.Link) error { return nil }, nil
+	}
+
+	return &ls
+}
+
+// pushConcurrency returns how many objects a push stores at once.
+func (p *Pfg) pushConcurrency() int {
+	if p.config.PushConcurrency > 0 {
+		return p.config.PushConcurrency
+	}
+
+	return gitremote.DefaultConcurrency
+}
+
+// looseObject encodes obj in its loose form, "<type> <size>\x00<content>",
+// which is what its hash is taken of.
+func looseObject(obj plumbing.EncodedObject) ([]byte, error) {
+	r, err := obj.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var buf bytes.Buffer
+	buf.Grow(int(obj.Size()) + 32)
+	_, _ = fmt.Fprintf(&buf, "%s %d\x00", obj.Type(), obj.Size())
+
+	if _, err = io.Copy(&buf, r); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// storeObject writes raw through ls under the CID of h, unless the object
+// store has it already, and reports whether it did.
+func (p *Pfg) storeObject(ctx context.Context, ls *ipld.LinkSystem, h plumbing.Hash, raw []byte) (bool, error) {
+	c, err := gitremote.CidFromHex(h.String())
+	if err != nil {
+		return false, err
+	}
+
+	lnk := cidlink.Link{Cid: c}
+
+	has, err := p.store.Has(ctx, lnk.Binary())
+	if err != nil || has {
+		return false, err
+	}
+
+	w, commit, err := ls.StorageWriteOpener(ipld.LinkContext{Ctx: ctx})
+	if err != nil {
+		return false, err
+	}
+
+	if _, err = w.Write(raw); err != nil {
+		return false, err
+	}
+
+	return true, commit(lnk)
+}
@@ -0,0 +1,85 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	ipldgit "github.com/drgomesp/git-remote-ipldprime/core"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"github.com/rs/zerolog/log"
+
+	gitremotepfg "github.com/peerforge/peerforge/internal/git-remote-pfg"
+	"github.com/peerforge/peerforge/pkg/config"
+	"github.com/peerforge/peerforge/pkg/gitremote"
+)
+
+// SetHead points HEAD of the PeerForge remote of the repository at dir to
+// branch, given either short ("trunk") or in full ("refs/heads/trunk").
+func SetHead(dir string, branch string) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+
+	r, err := git.PlainOpen(dir)
+	if err != nil {
+		return err
+	}
+
+	gitDir, err := gitDirOf(r)
+	if err != nil {
+		return err
+	}
+
+	// The handler finds the repository through GIT_DIR, as when git runs
+	// it.
+	_ = os.Setenv("GIT_DIR", gitDir)
+
+	remote, err := r.Remote(RemoteName)
+	if err != nil {
+		return err
+	}
+
+	name := strings.TrimPrefix(remote.Config().URLs[0], gitremotepfg.URLScheme)
+	if name == "" {
+		return fmt.Errorf("remote %s has not been pushed to yet", RemoteName)
+	}
+
+	tracker, err := ipldgit.NewTracker()
+	if err != nil {
+		return err
+	}
+
+	pfg, err := gitremotepfg.NewPfg(tracker, RemoteName, name)
+	if err != nil {
+		return err
+	}
+
+	if err = pfg.Initialize(tracker, r, gitremote.NewOptions()); err != nil {
+		return err
+	}
+
+	ref := config.BranchRef(branch)
+	if err = pfg.SetHead(context.Background(), ref); err != nil {
+		return err
+	}
+
+	log.Info().Msgf("HEAD of %s points at %s", RemoteName, ref)
+
+	return pfg.Finish()
+}
+
+// gitDirOf returns the git directory of r: the .git directory of a
+// worktree, or the repository itself when it is bare.
+func gitDirOf(r *git.Repository) (string, error) {
+	st, ok := r.Storer.(*filesystem.Storage)
+	if !ok {
+		return "", fmt.Errorf("repository isn't stored on disk")
+	}
+
+	return st.Filesystem().Root(), nil
+}
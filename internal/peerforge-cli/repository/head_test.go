@@ -0,0 +1,37 @@
+package repository
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGitDirOf(t *testing.T) {
+	tests := []struct {
+		name string
+		bare bool
+		want func(dir string) string
+	}{
+		{name: "worktree", want: func(dir string) string { return filepath.Join(dir, git.GitDirName) }},
+		{name: "bare", bare: true, want: func(dir string) string { return dir }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			_, err := git.PlainInit(dir, tt.bare)
+			assert.NoError(t, err)
+
+			r, err := git.PlainOpen(dir)
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			got, err := gitDirOf(r)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want(dir), got)
+		})
+	}
+}
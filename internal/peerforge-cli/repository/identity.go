@@ -0,0 +1,23 @@
+package repository
+
+import (
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"github.com/peerforge/peerforge/pkg/naming"
+)
+
+// Identity returns the peer ID repositories are published under, as used
+// in remote URLs like pfg://<peer id>/<repo>.
+func Identity() (peer.ID, error) {
+	dir, err := naming.DefaultDir()
+	if err != nil {
+		return "", err
+	}
+
+	key, err := naming.NewResolver(dir).Identity()
+	if err != nil {
+		return "", err
+	}
+
+	return peer.IDFromPrivateKey(key)
+}
@@ -27,6 +27,7 @@ import (
 
 	peerforgeevent "github.com/peerforge/peerforge/internal/git-remote-pfg"
 	peerforge "github.com/peerforge/peerforge/pkg"
+	pfgconfig "github.com/peerforge/peerforge/pkg/config"
 	"github.com/peerforge/peerforge/pkg/gitremote"
 )
 
@@ -36,7 +37,7 @@ var (
 
 const (
 	RemoteName     = "peerforge"
-	ConfigFileName = ".peerforge.yaml"
+	ConfigFileName = pfgconfig.FileName
 	DefaultConfig  = `{"foo": "bar"}`
 )
 
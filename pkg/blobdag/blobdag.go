@@ -0,0 +1,349 @@
+// Package blobdag stores large blobs as a balanced DAG of content-defined
+// chunks, so versions of a blob that differ by a few bytes share most of
+// their blocks.
+//
+// Chunks are stored as raw blocks. They are linked from dag-cbor nodes of
+// up to Width entries, themselves linked from nodes of the level above
+// until a single node remains:
+//
+//	type Node struct {
+//		size  Int     # bytes of data below the node
+//		links [Entry]
+//	}
+//
+//	type Entry struct {
+//		link Link     # to a chunk or a Node
+//		size Int
+//	}
+//
+// A blob that fits in a single chunk is stored as that chunk alone.
+package blobdag
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent/qp"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	mh "github.com/multiformats/go-multihash"
+
+	_ "github.com/ipld/go-ipld-prime/codec/dagcbor"
+	_ "github.com/ipld/go-ipld-prime/codec/raw"
+)
+
+const (
+	// DefaultChunkSize is the average size of chunks.
+	DefaultChunkSize = 1 << 18
+	// Width is the maximum number of links of a node.
+	Width = 256
+)
+
+var (
+	chunkPrototype = cidlink.LinkPrototype{Prefix: cid.Prefix{
+		Version:  1,
+		Codec:    cid.Raw,
+		MhType:   mh.SHA2_256,
+		MhLength: -1,
+	}}
+	nodePrototype = cidlink.LinkPrototype{Prefix: cid.Prefix{
+		Version:  1,
+		Codec:    cid.DagCBOR,
+		MhType:   mh.SHA2_256,
+		MhLength: -1,
+	}}
+)
+
+type entry struct {
+	link cid.Cid
+	size int64
+}
+
+// Write stores data as a DAG of chunks averaging chunkSize bytes and
+// returns the CID of its root.
+func Write(ctx context.Context, ls *ipld.LinkSystem, data []byte, chunkSize int) (cid.Cid, error) {
+	return WriteFrom(ctx, ls, bytes.NewReader(data), chunkSize)
+}
+
+// WriteFrom stores what it reads from r as Write would, one chunk at a
+// time.
+func WriteFrom(ctx context.Context, ls *ipld.LinkSystem, r io.Reader, chunkSize int) (cid.Cid, error) {
+	chunker, err := NewChunker(r, chunkSize)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	var level []entry
+	for {
+		chunk, err := chunker.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return cid.Undef, err
+		}
+
+		lnk, err := ls.Store(ipld.LinkContext{Ctx: ctx}, chunkPrototype, basicnode.NewBytes(chunk))
+		if err != nil {
+			return cid.Undef, err
+		}
+
+		level = append(level, entry{link: lnk.(cidlink.Link).Cid, size: int64(len(chunk))})
+	}
+
+	if len(level) == 0 {
+		lnk, err := ls.Store(ipld.LinkContext{Ctx: ctx}, chunkPrototype, basicnode.NewBytes(nil))
+		if err != nil {
+			return cid.Undef, err
+		}
+
+		return lnk.(cidlink.Link).Cid, nil
+	}
+
+	for len(level) > 1 {
+		if level, err = storeLevel(ctx, ls, level); err != nil {
+			return cid.Undef, err
+		}
+	}
+
+	return level[0].link, nil
+}
+
+// storeLevel stores the nodes linking entries, Width at a time, and returns
+// the entries of the level above.
+func storeLevel(ctx context.Context, ls *ipld.LinkSystem, entries []entry) ([]entry, error) {
+	next := make([]entry, 0, len(entries)/Width+1)
+	for len(entries) > 0 {
+		n := Width
+		if n > len(entries) {
+			n = len(entries)
+		}
+
+		e, err := storeNode(ctx, ls, entries[:n])
+		if err != nil {
+			return nil, err
+		}
+
+		next = append(next, e)
+		entries = entries[n:]
+	}
+
+	return next, nil
+}
+
+func storeNode(ctx context.Context, ls *ipld.LinkSystem, entries []entry) (entry, error) {
+	var size int64
+	for _, e := range entries {
+		size += e.size
+	}
+
+	n, err := qp.BuildMap(basicnode.Prototype.Map, 2, func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, "size", qp.Int(size))
+		qp.MapEntry(ma, "links", qp.List(int64(len(entries)), func(la datamodel.ListAssembler) {
+			for _, e := range entries {
+				qp.ListEntry(la, qp.Map(2, func(ma datamodel.MapAssembler) {
+					qp.MapEntry(ma, "link", qp.Link(cidlink.Link{Cid: e.link}))
+					qp.MapEntry(ma, "size", qp.Int(e.size))
+				}))
+			}
+		}))
+	})
+	if err != nil {
+		return entry{}, err
+	}
+
+	lnk, err := ls.Store(ipld.LinkContext{Ctx: ctx}, nodePrototype, n)
+	if err != nil {
+		return entry{}, err
+	}
+
+	return entry{link: lnk.(cidlink.Link).Cid, size: size}, nil
+}
+
+// Read reassembles the blob stored under c by Write.
+func Read(ctx context.Context, ls *ipld.LinkSystem, c cid.Cid) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := Copy(ctx, ls, c, &buf); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Copy writes the blob stored under c by Write to w, one chunk at a time.
+func Copy(ctx context.Context, ls *ipld.LinkSystem, c cid.Cid, w io.Writer) error {
+	if c.Type() == cid.Raw {
+		data, err := ls.LoadRaw(ipld.LinkContext{Ctx: ctx}, cidlink.Link{Cid: c})
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(data)
+		return err
+	}
+
+	entries, err := loadNode(ctx, ls, c)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if err := Copy(ctx, ls, e.link, w); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ReadAt reads n bytes of the blob stored under c by Write, starting at
+// off. Only the chunks holding them are loaded.
+func ReadAt(ctx context.Context, ls *ipld.LinkSystem, c cid.Cid, off int64, n int64) ([]byte, error) {
+	if off < 0 || n < 0 {
+		return nil, fmt.Errorf("invalid range %d+%d", off, n)
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, n))
+	if err := readAt(ctx, ls, c, off, n, buf); err != nil {
+		return nil, err
+	}
+
+	if int64(buf.Len()) != n {
+		return nil, fmt.Errorf("range %d+%d past the end of %s", off, n, c)
+	}
+
+	return buf.Bytes(), nil
+}
+
+func readAt(ctx context.Context, ls *ipld.LinkSystem, c cid.Cid, off int64, n int64, buf *bytes.Buffer) error {
+	if c.Type() == cid.Raw {
+		data, err := ls.LoadRaw(ipld.LinkContext{Ctx: ctx}, cidlink.Link{Cid: c})
+		if err != nil {
+			return err
+		}
+
+		if off >= int64(len(data)) {
+			return nil
+		}
+		if end := off + n; end < int64(len(data)) {
+			data = data[:end]
+		}
+
+		_, err = buf.Write(data[off:])
+		return err
+	}
+
+	entries, err := loadNode(ctx, ls, c)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if n <= 0 {
+			break
+		}
+		if off >= e.size {
+			off -= e.size
+			continue
+		}
+
+		before := int64(buf.Len())
+		if err := readAt(ctx, ls, e.link, off, n, buf); err != nil {
+			return err
+		}
+
+		n -= int64(buf.Len()) - before
+		off = 0
+	}
+
+	return nil
+}
+
+// Size returns the size of the blob stored under c by Write, reading only
+// its root.
+func Size(ctx context.Context, ls *ipld.LinkSystem, c cid.Cid) (int64, error) {
+	if c.Type() == cid.Raw {
+		data, err := ls.LoadRaw(ipld.LinkContext{Ctx: ctx}, cidlink.Link{Cid: c})
+		if err != nil {
+			return 0, err
+		}
+
+		return int64(len(data)), nil
+	}
+
+	n, err := ls.Load(ipld.LinkContext{Ctx: ctx}, cidlink.Link{Cid: c}, basicnode.Prototype.Map)
+	if err != nil {
+		return 0, err
+	}
+
+	sv, err := n.LookupByString("size")
+	if err != nil {
+		return 0, fmt.Errorf("blob node %s: %w", c, err)
+	}
+
+	return sv.AsInt()
+}
+
+func loadNode(ctx context.Context, ls *ipld.LinkSystem, c cid.Cid) ([]entry, error) {
+	n, err := ls.Load(ipld.LinkContext{Ctx: ctx}, cidlink.Link{Cid: c}, basicnode.Prototype.Map)
+	if err != nil {
+		return nil, err
+	}
+
+	links, err := n.LookupByString("links")
+	if err != nil {
+		return nil, fmt.Errorf("blob node %s: %w", c, err)
+	}
+
+	entries := make([]entry, 0, links.Length())
+	it := links.ListIterator()
+	if it == nil {
+		return nil, fmt.Errorf("blob node %s: links isn't a list", c)
+	}
+
+	for !it.Done() {
+		_, v, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := decodeEntry(v)
+		if err != nil {
+			return nil, fmt.Errorf("blob node %s: %w", c, err)
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+func decodeEntry(n datamodel.Node) (entry, error) {
+	lv, err := n.LookupByString("link")
+	if err != nil {
+		return entry{}, err
+	}
+
+	lnk, err := lv.AsLink()
+	if err != nil {
+		return entry{}, err
+	}
+
+	sv, err := n.LookupByString("size")
+	if err != nil {
+		return entry{}, err
+	}
+
+	size, err := sv.AsInt()
+	if err != nil {
+		return entry{}, err
+	}
+
+	return entry{link: lnk.(cidlink.Link).Cid, size: size}, nil
+}
@@ -0,0 +1,149 @@
+package blobdag
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"testing"
+	"testing/iotest"
+
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/storage/memstore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplit(t *testing.T) {
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	chunks, err := Split(data, 1<<12)
+	assert.NoError(t, err)
+
+	var total int
+	for i, chunk := range chunks {
+		total += len(chunk)
+		if i < len(chunks)-1 {
+			assert.GreaterOrEqual(t, len(chunk), 1<<10)
+		}
+		assert.LessOrEqual(t, len(chunk), 1<<14)
+	}
+	assert.Equal(t, len(data), total)
+
+	_, err = Split(data, 3000)
+	assert.Error(t, err)
+}
+
+func TestWriteRead(t *testing.T) {
+	ctx := context.Background()
+	ls := cidlink.DefaultLinkSystem()
+	st := &memstore.Store{}
+	ls.SetReadStorage(st)
+	ls.SetWriteStorage(st)
+
+	const chunkSize = 1 << 10
+
+	for _, size := range []int{0, 100, chunkSize * 3, chunkSize * Width * 2} {
+		data := make([]byte, size)
+		rand.New(rand.NewSource(int64(size))).Read(data)
+
+		c, err := Write(ctx, &ls, data, chunkSize)
+		assert.NoError(t, err)
+
+		got, err := Read(ctx, &ls, c)
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(data, got), "size %d", size)
+
+		n, err := Size(ctx, &ls, c)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(size), n)
+
+		for _, r := range [][2]int{{0, size}, {size / 3, size / 2}, {size - size/7, size / 7}, {size, 0}} {
+			part, err := ReadAt(ctx, &ls, c, int64(r[0]), int64(r[1]))
+			assert.NoError(t, err)
+			assert.True(t, bytes.Equal(data[r[0]:r[0]+r[1]], part), "size %d, range %v", size, r)
+		}
+
+		_, err = ReadAt(ctx, &ls, c, int64(size), 1)
+		assert.Error(t, err)
+	}
+}
+
+func TestWrite_Dedup(t *testing.T) {
+	ctx := context.Background()
+	ls := cidlink.DefaultLinkSystem()
+	st := &memstore.Store{}
+	ls.SetReadStorage(st)
+	ls.SetWriteStorage(st)
+
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(2)).Read(data)
+
+	_, err := Write(ctx, &ls, data, 1<<12)
+	assert.NoError(t, err)
+	before := len(st.Bag)
+
+	edited := append([]byte{}, data[:1<<19]...)
+	edited = append(edited, []byte("a few inserted bytes")...)
+	edited = append(edited, data[1<<19:]...)
+
+	c, err := Write(ctx, &ls, edited, 1<<12)
+	assert.NoError(t, err)
+	assert.NotEqual(t, cid.Undef, c)
+
+	// The edit adds a couple of chunks and rewrites the nodes above them.
+	assert.Less(t, len(st.Bag)-before, 8)
+}
+
+func TestChunker(t *testing.T) {
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(3)).Read(data)
+
+	for _, size := range []int{1 << 10, 1 << 12, 1 << 16} {
+		want, err := Split(data, size)
+		assert.NoError(t, err)
+
+		chunker, err := NewChunker(iotest.HalfReader(bytes.NewReader(data)), size)
+		assert.NoError(t, err)
+
+		var got [][]byte
+		for {
+			chunk, err := chunker.Next()
+			if err == io.EOF {
+				break
+			}
+			if !assert.NoError(t, err) {
+				break
+			}
+			got = append(got, append([]byte{}, chunk...))
+		}
+
+		assert.Equal(t, want, got, "size %d", size)
+	}
+
+	_, err := NewChunker(bytes.NewReader(data), 3000)
+	assert.Error(t, err)
+}
+
+func TestCopy(t *testing.T) {
+	ctx := context.Background()
+	ls := cidlink.DefaultLinkSystem()
+	st := &memstore.Store{}
+	ls.SetReadStorage(st)
+	ls.SetWriteStorage(st)
+
+	data := make([]byte, 1<<18)
+	rand.New(rand.NewSource(4)).Read(data)
+
+	c, err := WriteFrom(ctx, &ls, bytes.NewReader(data), 1<<10)
+	assert.NoError(t, err)
+
+	want, err := Write(ctx, &ls, data, 1<<10)
+	assert.NoError(t, err)
+	assert.Equal(t, want, c, "WriteFrom stores what Write does")
+
+	var buf bytes.Buffer
+	assert.NoError(t, Copy(ctx, &ls, c, &buf))
+	assert.True(t, bytes.Equal(data, buf.Bytes()))
+}
@@ -0,0 +1,122 @@
+package blobdag
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// gear holds a random value per byte for the rolling hash of the chunker.
+// It is generated from a fixed seed: changing it moves every chunk boundary
+// and breaks deduplication with data stored before.
+var gear [256]uint64
+
+func init() {
+	seed := uint64(0x5046472d63686e6b) // "PFG-chnk"
+	for i := range gear {
+		// splitmix64
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+// MinChunkSize is the smallest average chunk size Split accepts.
+const MinChunkSize = 1 << 10
+
+// Split cuts data into content-defined chunks averaging size bytes, which
+// must be a power of two. Boundaries depend on the bytes around them only,
+// so an edit changes the chunks it touches and leaves the others as they
+// were. Chunks are between size/4 and size*4 bytes, the last one aside.
+func Split(data []byte, size int) ([][]byte, error) {
+	if err := CheckChunkSize(size); err != nil {
+		return nil, err
+	}
+
+	chunks := make([][]byte, 0, len(data)/size+1)
+	for len(data) > 0 {
+		n := cut(data, size/4, size*4, uint64(size-1))
+		chunks = append(chunks, data[:n])
+		data = data[n:]
+	}
+
+	return chunks, nil
+}
+
+// Chunker cuts what it reads into the chunks Split would cut it into,
+// holding no more than the largest chunk in memory.
+type Chunker struct {
+	r    io.Reader
+	size int
+	// buf holds the bytes read and not returned yet from start to end.
+	buf        []byte
+	start, end int
+	eof        bool
+}
+
+// NewChunker returns a Chunker reading r, for chunks averaging size bytes.
+func NewChunker(r io.Reader, size int) (*Chunker, error) {
+	if err := CheckChunkSize(size); err != nil {
+		return nil, err
+	}
+
+	return &Chunker{r: r, size: size, buf: make([]byte, size*4)}, nil
+}
+
+// Next returns the next chunk, valid until the following call, or io.EOF
+// once everything was read.
+func (c *Chunker) Next() ([]byte, error) {
+	c.end = copy(c.buf, c.buf[c.start:c.end])
+	c.start = 0
+
+	if !c.eof && c.end < len(c.buf) {
+		n, err := io.ReadFull(c.r, c.buf[c.end:])
+		c.end += n
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.end == 0 {
+		return nil, io.EOF
+	}
+
+	c.start = cut(c.buf[:c.end], c.size/4, c.size*4, uint64(c.size-1))
+
+	return c.buf[:c.start], nil
+}
+
+// cut returns the length of the first chunk of data: up to the first
+// position past min where the gear hash has its mask bits cleared, or max.
+func cut(data []byte, min, max int, mask uint64) int {
+	if len(data) <= min {
+		return len(data)
+	}
+	if len(data) > max {
+		data = data[:max]
+	}
+
+	var h uint64
+	for i := min; i < len(data); i++ {
+		h = (h << 1) + gear[data[i]]
+		if h&mask == 0 {
+			return i + 1
+		}
+	}
+
+	return len(data)
+}
+
+// CheckChunkSize reports whether size is usable as the average chunk size
+// of Split.
+func CheckChunkSize(size int) error {
+	if size < MinChunkSize || size&(size-1) != 0 {
+		return fmt.Errorf("invalid chunk size %d: must be a power of two of at least %d", size, MinChunkSize)
+	}
+
+	return nil
+}
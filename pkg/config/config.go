@@ -0,0 +1,142 @@
+// Package config reads the per-repository PeerForge settings kept in
+// .peerforge.yaml at the root of the worktree.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	format "github.com/go-git/go-git/v5/plumbing/format/config"
+	"github.com/peerforge/peerforge/pkg/gitfmt"
+	"gopkg.in/yaml.v3"
+)
+
+// FileName is the name of the configuration file, relative to the root of
+// the worktree.
+const FileName = ".peerforge.yaml"
+
+const branchPrefix = "refs/heads/"
+
+// GitSection is the git config section of the settings that can be
+// overridden per clone, e.g. "git config pfg.largeObjectThreshold 8m".
+const GitSection = "pfg"
+
+type Config struct {
+	// DefaultBranch is the branch the remote HEAD points at after the
+	// first push, either short ("trunk") or in full ("refs/heads/trunk").
+	// When empty, the first branch pushed is used.
+	DefaultBranch string `yaml:"defaultBranch"`
+	// LargeObjectThreshold is the size above which git objects are stored
+	// as chunked blobs. Zero keeps the setting of the repository.
+	LargeObjectThreshold Size `yaml:"largeObjectThreshold"`
+	// ChunkSize is the average size of the chunks of large objects, a
+	// power of two. Zero keeps the setting of the repository.
+	ChunkSize Size `yaml:"chunkSize"`
+	// PushConcurrency is the number of objects a push stores at once. Zero
+	// lets the helper pick.
+	PushConcurrency int `yaml:"pushConcurrency"`
+	// Node is the base URL of a PeerForge node serving the repository
+	// over git protocol v2, e.g. "https://node.example.com". When empty,
+	// objects are transferred one by one.
+	Node string `yaml:"node"`
+	// Layout is how pushes store git objects: "objects", one block per
+	// object, or "packs", one packfile per push. Empty keeps the layout
+	// of the repository. It is checked by the helper using it.
+	Layout string `yaml:"layout"`
+}
+
+// Size is a number of bytes, written either as an integer or with a k, m
+// or g suffix like git sizes, e.g. "512k".
+type Size int64
+
+func (s *Size) UnmarshalYAML(value *yaml.Node) error {
+	v, err := gitfmt.ParseSize(value.Value)
+	*s = Size(v)
+	return err
+}
+
+// ApplyGitConfig overrides the settings found in the pfg section of a git
+// configuration.
+func (c *Config) ApplyGitConfig(raw *format.Config) (err error) {
+	if !raw.HasSection(GitSection) {
+		return nil
+	}
+
+	opts := raw.Section(GitSection).Options
+	for key, size := range map[string]*Size{
+		"largeObjectThreshold": &c.LargeObjectThreshold,
+		"chunkSize":            &c.ChunkSize,
+	} {
+		if !opts.Has(key) {
+			continue
+		}
+
+		v, err := gitfmt.ParseSize(opts.Get(key))
+		if err != nil {
+			return fmt.Errorf("%s.%s: %w", GitSection, key, err)
+		}
+
+		*size = Size(v)
+	}
+
+	if opts.Has("node") {
+		c.Node = opts.Get("node")
+	}
+
+	if opts.Has("layout") {
+		c.Layout = opts.Get("layout")
+	}
+
+	if key := "pushConcurrency"; opts.Has(key) {
+		n, err := strconv.Atoi(opts.Get(key))
+		if err != nil || n < 0 {
+			return fmt.Errorf("%s.%s: invalid count %q", GitSection, key, opts.Get(key))
+		}
+		c.PushConcurrency = n
+	}
+
+	return nil
+}
+
+// Load reads the configuration file of the worktree at dir. A missing file
+// yields the zero Config.
+func Load(dir string) (*Config, error) {
+	data, err := os.ReadFile(filepath.Join(dir, FileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return &Config{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg Config
+	if err = yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", FileName, err)
+	}
+
+	if cfg.PushConcurrency < 0 {
+		return nil, fmt.Errorf("%s: invalid pushConcurrency %d", FileName, cfg.PushConcurrency)
+	}
+
+	return &cfg, nil
+}
+
+// DefaultBranchRef returns DefaultBranch as a full ref name, or an empty
+// string when it isn't set.
+func (c *Config) DefaultBranchRef() string {
+	return BranchRef(c.DefaultBranch)
+}
+
+// BranchRef expands a short branch name to a full ref name. Full names and
+// the empty string are returned as is.
+func BranchRef(name string) string {
+	if name == "" || strings.HasPrefix(name, "refs/") {
+		return name
+	}
+
+	return branchPrefix + name
+}
@@ -0,0 +1,107 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	format "github.com/go-git/go-git/v5/plumbing/format/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+		wantErr bool
+	}{
+		{name: "missing file"},
+		{name: "short name", content: "defaultBranch: trunk\n", want: "refs/heads/trunk"},
+		{name: "full name", content: "defaultBranch: refs/heads/master\n", want: "refs/heads/master"},
+		{name: "json", content: `{"foo": "bar", "defaultBranch": "main"}`, want: "refs/heads/main"},
+		{name: "invalid", content: "defaultBranch: [", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if tt.content != "" {
+				assert.NoError(t, os.WriteFile(filepath.Join(dir, FileName), []byte(tt.content), 0644))
+			}
+
+			cfg, err := Load(dir)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, cfg.DefaultBranchRef())
+		})
+	}
+}
+
+func TestConfig_Sizes(t *testing.T) {
+	cfg, err := Load(writeConfig(t, "largeObjectThreshold: 8m\nchunkSize: 65536\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, Size(8<<20), cfg.LargeObjectThreshold)
+	assert.Equal(t, Size(64<<10), cfg.ChunkSize)
+
+	raw := format.New()
+	raw.Section(GitSection).SetOption("largeobjectthreshold", "512k")
+	assert.NoError(t, cfg.ApplyGitConfig(raw))
+	assert.Equal(t, Size(512<<10), cfg.LargeObjectThreshold, "git config wins")
+	assert.Equal(t, Size(64<<10), cfg.ChunkSize)
+
+	raw.Section(GitSection).SetOption("chunkSize", "lots")
+	assert.Error(t, cfg.ApplyGitConfig(raw))
+
+	_, err = Load(writeConfig(t, "chunkSize: -1\n"))
+	assert.Error(t, err)
+}
+
+func TestConfig_PushConcurrency(t *testing.T) {
+	cfg, err := Load(writeConfig(t, "pushConcurrency: 16\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, 16, cfg.PushConcurrency)
+
+	raw := format.New()
+	raw.Section(GitSection).SetOption("pushconcurrency", "4")
+	assert.NoError(t, cfg.ApplyGitConfig(raw))
+	assert.Equal(t, 4, cfg.PushConcurrency, "git config wins")
+
+	raw.Section(GitSection).SetOption("pushConcurrency", "-2")
+	assert.Error(t, cfg.ApplyGitConfig(raw))
+
+	_, err = Load(writeConfig(t, "pushConcurrency: -1\n"))
+	assert.Error(t, err)
+}
+
+func TestConfig_Node(t *testing.T) {
+	cfg, err := Load(writeConfig(t, "node: https://node.example.com\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "https://node.example.com", cfg.Node)
+
+	raw := format.New()
+	raw.Section(GitSection).SetOption("node", "http://localhost:8080")
+	assert.NoError(t, cfg.ApplyGitConfig(raw))
+	assert.Equal(t, "http://localhost:8080", cfg.Node, "git config wins")
+}
+
+func TestConfig_Layout(t *testing.T) {
+	cfg, err := Load(writeConfig(t, "layout: packs\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "packs", cfg.Layout)
+
+	raw := format.New()
+	raw.Section(GitSection).SetOption("layout", "objects")
+	assert.NoError(t, cfg.ApplyGitConfig(raw))
+	assert.Equal(t, "objects", cfg.Layout, "git config wins")
+}
+
+func writeConfig(t *testing.T, content string) string {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, FileName), []byte(content), 0644))
+
+	return dir
+}
@@ -0,0 +1,33 @@
+// Package gitfmt holds the pieces of git's notation shared by the
+// PeerForge packages that read or write it.
+package gitfmt
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PeeledSuffix marks the entry holding the commit an annotated tag peels
+// to, e.g. "refs/tags/v1.0.0^{}", listed next to the tag itself.
+const PeeledSuffix = "^{}"
+
+// ParseSize parses a size the way git does, either as a number of bytes or
+// with a k, m or g suffix, e.g. "2097152", "2048k" or "2m".
+func ParseSize(s string) (int64, error) {
+	units := map[byte]int64{'k': 1 << 10, 'm': 1 << 20, 'g': 1 << 30}
+
+	num, unit := strings.ToLower(strings.TrimSpace(s)), int64(1)
+	if n := len(num); n > 0 {
+		if u, ok := units[num[n-1]]; ok {
+			num, unit = num[:n-1], u
+		}
+	}
+
+	v, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+
+	return v * unit, nil
+}
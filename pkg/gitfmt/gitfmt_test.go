@@ -0,0 +1,36 @@
+package gitfmt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSize(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want int64
+		err  bool
+	}{
+		{in: "2097152", want: 2097152},
+		{in: "2048k", want: 2 << 20},
+		{in: "2M", want: 2 << 20},
+		{in: " 1g ", want: 1 << 30},
+		{in: "0", want: 0},
+		{in: "", err: true},
+		{in: "k", err: true},
+		{in: "-1", err: true},
+		{in: "lots", err: true},
+	} {
+		t.Run(tc.in, func(t *testing.T) {
+			got, err := ParseSize(tc.in)
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
@@ -3,9 +3,13 @@ package gitremote
 import "strings"
 
 const (
-	CmdList  = "list"
-	CmdPush  = "push"
-	CmdFetch = "fetch"
+	CmdList   = "list"
+	CmdPush   = "push"
+	CmdFetch  = "fetch"
+	CmdOption = "option"
+	// CmdStatelessConnect is only advertised by handlers implementing
+	// StatelessConnector.
+	CmdStatelessConnect = "stateless-connect"
 )
 
-var DefaultCapabilities = strings.Join([]string{CmdPush, CmdFetch}, "\n")
+var DefaultCapabilities = strings.Join([]string{CmdPush, CmdFetch, CmdOption}, "\n")
@@ -0,0 +1,175 @@
+package gitremote
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// StatelessConnector is implemented by handlers advertising the
+// stateless-connect capability, which lets git speak protocol v2 to a
+// PeerForge node building and consuming packfiles from the objects it
+// stores, instead of transferring them one by one.
+type StatelessConnector interface {
+	// ServiceURL returns the smart HTTP URL of the repository for service,
+	// e.g. git-upload-pack, or an empty string to have git fall back to
+	// the fetch and push capabilities.
+	ServiceURL(service string) (string, error)
+}
+
+// Packets of git protocol v2 without a payload.
+const (
+	pktFlush       = "0000"
+	pktResponseEnd = "0002"
+)
+
+// StatelessConnect proxies the protocol v2 session git opens on r and w for
+// service to the smart HTTP endpoint at url, the way git's remote-curl does.
+// The capability advertisement comes from "GET <url>/info/refs", then
+// every request git sends, up to its flush packet, is posted to
+// "<url>/<service>" and the response passed back, ended with a
+// response-end packet. It returns once git closes r.
+func StatelessConnect(client *http.Client, url string, service string, r io.Reader, w io.Writer) error {
+	url = strings.TrimSuffix(url, "/")
+
+	if err := advertise(client, url, service, w); err != nil {
+		return err
+	}
+
+	for {
+		req, err := readRequest(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err = post(client, url, service, req, w); err != nil {
+			return err
+		}
+
+		if _, err = io.WriteString(w, pktResponseEnd); err != nil {
+			return err
+		}
+	}
+}
+
+// advertise passes the capability advertisement of the server on to git,
+// without the "# service=" header smart HTTP servers may put first.
+func advertise(client *http.Client, url string, service string, w io.Writer) error {
+	req, err := http.NewRequest(http.MethodGet, url+"/info/refs?service="+service, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Git-Protocol", "version=2")
+
+	body, err := do(client, req)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	first, err := readPacket(body)
+	if err != nil {
+		return fmt.Errorf("%s advertisement: %w", service, err)
+	}
+
+	if bytes.HasPrefix(first[4:], []byte("# service=")) {
+		// The header is followed by a flush packet.
+		if _, err = readPacket(body); err != nil {
+			return fmt.Errorf("%s advertisement: %w", service, err)
+		}
+	} else if _, err = w.Write(first); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, body)
+	return err
+}
+
+func post(client *http.Client, url string, service string, body []byte, w io.Writer) error {
+	req, err := http.NewRequest(http.MethodPost, url+"/"+service, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-"+service+"-request")
+	req.Header.Set("Accept", "application/x-"+service+"-result")
+	req.Header.Set("Git-Protocol", "version=2")
+
+	resp, err := do(client, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Close()
+
+	_, err = io.Copy(w, resp)
+	return err
+}
+
+func do(client *http.Client, req *http.Request) (io.ReadCloser, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s", req.Method, req.URL, resp.Status)
+	}
+
+	return resp.Body, nil
+}
+
+// readRequest reads the packets of a single request from git, up to and
+// including its flush packet. It returns io.EOF when git has nothing more
+// to send.
+func readRequest(r io.Reader) ([]byte, error) {
+	var req []byte
+	for {
+		pkt, err := readPacket(r)
+		if err == io.EOF && len(req) > 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		req = append(req, pkt...)
+		if string(pkt) == pktFlush {
+			return req, nil
+		}
+	}
+}
+
+// readPacket reads a pkt-line, returning it whole with its length prefix.
+func readPacket(r io.Reader) ([]byte, error) {
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+
+	n, err := strconv.ParseUint(string(head), 16, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid packet length %q", head)
+	}
+
+	switch {
+	case n <= 2:
+		return head, nil
+	case n == 3:
+		return nil, errors.New("invalid packet length 3")
+	}
+
+	pkt := make([]byte, n)
+	copy(pkt, head)
+	if _, err = io.ReadFull(r, pkt[4:]); err != nil {
+		return nil, err
+	}
+
+	return pkt, nil
+}
@@ -0,0 +1,81 @@
+package gitremote
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatelessConnect(t *testing.T) {
+	const capabilities = "000eversion 2\n0013ls-refs=unborn\n0000"
+
+	tests := []struct {
+		name   string
+		header string
+		in     string
+		want   string
+	}{
+		{
+			name: "no request",
+			want: capabilities,
+		},
+		{
+			name:   "service header",
+			header: "001e# service=git-upload-pack\n0000",
+			in:     "0014command=ls-refs\n0000",
+			want:   capabilities + "echo 0014command=ls-refs\n0000" + "0002",
+		},
+		{
+			name: "requests",
+			in:   "0014command=ls-refs\n00010009peel\n0000" + "0012command=fetch\n0000",
+			want: capabilities +
+				"echo 0014command=ls-refs\n00010009peel\n0000" + "0002" +
+				"echo 0012command=fetch\n0000" + "0002",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "version=2", r.Header.Get("Git-Protocol"))
+
+				switch {
+				case r.Method == http.MethodGet && r.URL.Path == "/repo/info/refs":
+					assert.Equal(t, "git-upload-pack", r.URL.Query().Get("service"))
+					_, _ = io.WriteString(w, tt.header+capabilities)
+				case r.Method == http.MethodPost && r.URL.Path == "/repo/git-upload-pack":
+					assert.Equal(t, "application/x-git-upload-pack-request", r.Header.Get("Content-Type"))
+					_, _ = io.WriteString(w, "echo ")
+					_, _ = io.Copy(w, r.Body)
+				default:
+					http.NotFound(w, r)
+				}
+			}))
+			defer srv.Close()
+
+			var out bytes.Buffer
+			err := StatelessConnect(srv.Client(), srv.URL+"/repo/", "git-upload-pack", strings.NewReader(tt.in), &out)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, out.String())
+		})
+	}
+}
+
+func TestStatelessConnect_Errors(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	err := StatelessConnect(srv.Client(), srv.URL, "git-upload-pack", strings.NewReader(""), io.Discard)
+	assert.ErrorContains(t, err, "404")
+
+	_, err = readRequest(strings.NewReader("0014command=ls-refs\n"))
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	_, err = readPacket(strings.NewReader("zzzz"))
+	assert.Error(t, err)
+}
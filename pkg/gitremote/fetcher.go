@@ -0,0 +1,500 @@
+package gitremote
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// ObjectProvider is implemented by handlers able to hand out single git
+// objects, which lets Protocol fetch them with a Fetcher rather than one
+// ipldgit.Fetch walk per ref.
+type ObjectProvider interface {
+	// Object returns the object sha in its loose form, that is
+	// "<type> <size>\x00<content>".
+	Object(ctx context.Context, sha string) ([]byte, error)
+}
+
+// ObjectSizer is implemented by ObjectProviders able to tell the size of
+// an object without handing it out, which spares transferring the blobs a
+// Filter leaves out.
+type ObjectSizer interface {
+	// ObjectSize returns the size of the content of the object sha.
+	ObjectSize(ctx context.Context, sha string) (int64, error)
+}
+
+// Fetcher copies objects from an ObjectProvider into a local object
+// database, along with everything they reference that isn't there yet.
+//
+// Up to n objects are retrieved at once. Each one is verified and written
+// as soon as it arrives, by one goroutine at a time, then the objects it
+// references are queued. Objects already seen by the Fetcher are never
+// queued twice, so the refs of a batch should share one.
+//
+// With SetShallow, the walk stops following commit parents at a given
+// depth or date, and the Fetcher keeps track of the commits whose parents
+// were left out, for the shallow file of the local repository. With
+// SetFilter, blobs reached through trees are left out as the filter says,
+// while those asked for are always fetched.
+type Fetcher struct {
+	provider ObjectProvider
+	storer   storer.EncodedObjectStorer
+	n        int
+	progress *Progress
+	depth    int
+	since    time.Time
+	filter   *Filter
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// seen holds the depth every object was queued with.
+	seen map[plumbing.Hash]int
+	// queue holds the objects left to fetch, active counts those being
+	// fetched.
+	queue  []item
+	active int
+	err    error
+	// cut holds the commits fetched without their parents because of the
+	// depth, walked those fetched or read along with their parents.
+	// excluded holds the commits left out for being older than since,
+	// pruned the commits with an excluded parent and children the commits
+	// that led to each commit when since is set.
+	cut      map[plumbing.Hash]struct{}
+	walked   map[plumbing.Hash]struct{}
+	excluded map[plumbing.Hash]struct{}
+	pruned   map[plumbing.Hash]struct{}
+	children map[plumbing.Hash][]plumbing.Hash
+
+	// writeMu makes the storer, which isn't safe for concurrent use, see
+	// a single writer.
+	writeMu sync.Mutex
+}
+
+// item is an object queued by a Fetcher.
+type item struct {
+	hash plumbing.Hash
+	// depth is the number of commits left to fetch along the path to
+	// hash, zero when unlimited.
+	depth int
+	// child is the commit hash is a parent of, if any.
+	child plumbing.Hash
+	// through is set when a commit present locally must still be walked,
+	// as its history may be shallower than asked for.
+	through bool
+	// blob is set for the blobs of a tree, which a Filter applies to.
+	blob bool
+}
+
+// NewFetcher returns a Fetcher writing to s and retrieving up to n objects
+// at once. Received objects are reported on progress, which may be nil.
+func NewFetcher(provider ObjectProvider, s storer.EncodedObjectStorer, n int, progress *Progress) *Fetcher {
+	if n < 1 {
+		n = 1
+	}
+
+	f := &Fetcher{
+		provider: provider,
+		storer:   s,
+		n:        n,
+		progress: progress,
+		seen:     map[plumbing.Hash]int{},
+		cut:      map[plumbing.Hash]struct{}{},
+		walked:   map[plumbing.Hash]struct{}{},
+		excluded: map[plumbing.Hash]struct{}{},
+		pruned:   map[plumbing.Hash]struct{}{},
+		children: map[plumbing.Hash][]plumbing.Hash{},
+	}
+	f.cond = sync.NewCond(&f.mu)
+
+	return f
+}
+
+// SetShallow limits the history of the following fetches to depth commits
+// from each object asked for, and to commits no older than since. Zero
+// values leave the history unlimited.
+func (f *Fetcher) SetShallow(depth int, since time.Time) {
+	f.depth, f.since = depth, since
+}
+
+// SetFilter leaves out the blobs of the following fetches that filter,
+// which may be nil, rejects.
+func (f *Fetcher) SetFilter(filter *Filter) {
+	f.filter = filter
+}
+
+// Fetch retrieves hashes and the objects they reference. Objects present
+// locally are assumed to come with their history and aren't walked, unless
+// the history is limited by SetShallow.
+func (f *Fetcher) Fetch(ctx context.Context, hashes ...plumbing.Hash) error {
+	items := make([]item, len(hashes))
+	for i, h := range hashes {
+		items[i] = item{hash: h, depth: f.depth, through: f.depth > 0 || !f.since.IsZero()}
+	}
+
+	return f.run(ctx, items)
+}
+
+// Deepen retrieves the parents of commits, which are present locally, and
+// their history up to depth commits, zero meaning all of it.
+func (f *Fetcher) Deepen(ctx context.Context, depth int, commits ...plumbing.Hash) error {
+	if depth > 0 {
+		depth++
+	}
+
+	items := make([]item, len(commits))
+	for i, h := range commits {
+		items[i] = item{hash: h, depth: depth, through: true}
+	}
+
+	return f.run(ctx, items)
+}
+
+// Shallow returns the shallow commits of the local repository after the
+// fetches so far, given those it had before, in order.
+func (f *Fetcher) Shallow(current []plumbing.Hash) []plumbing.Hash {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	set := make(map[plumbing.Hash]struct{}, len(current)+len(f.cut)+len(f.pruned))
+	for _, h := range current {
+		set[h] = struct{}{}
+	}
+	for h := range f.cut {
+		set[h] = struct{}{}
+	}
+	for h := range f.walked {
+		delete(set, h)
+	}
+	for h := range f.pruned {
+		set[h] = struct{}{}
+	}
+
+	shallow := make([]plumbing.Hash, 0, len(set))
+	for h := range set {
+		shallow = append(shallow, h)
+	}
+	sort.Slice(shallow, func(i, j int) bool {
+		return bytes.Compare(shallow[i][:], shallow[j][:]) < 0
+	})
+
+	return shallow
+}
+
+func (f *Fetcher) run(ctx context.Context, items []item) error {
+	f.mu.Lock()
+	f.err = nil
+	f.enqueue(items)
+	f.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for i := 0; i < f.n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				it, ok := f.next()
+				if !ok {
+					return
+				}
+
+				refs, err := f.fetch(ctx, it)
+				f.done(refs, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	return f.err
+}
+
+// next waits for an object to fetch. It returns false once there is
+// nothing left to do, or the fetch failed.
+func (f *Fetcher) next() (item, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for len(f.queue) == 0 && f.active > 0 && f.err == nil {
+		f.cond.Wait()
+	}
+
+	if f.err != nil || len(f.queue) == 0 {
+		return item{}, false
+	}
+
+	it := f.queue[len(f.queue)-1]
+	f.queue = f.queue[:len(f.queue)-1]
+	f.active++
+
+	return it, true
+}
+
+// done queues the objects referenced by a fetched one, or records the
+// error it failed with, and wakes up the idle workers.
+func (f *Fetcher) done(refs []item, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.active--
+	if err != nil && f.err == nil {
+		f.err = err
+		f.queue = nil
+	}
+	if f.err == nil {
+		f.enqueue(refs)
+	}
+
+	f.cond.Broadcast()
+}
+
+// enqueue queues the items not seen yet, or seen with a smaller depth.
+func (f *Fetcher) enqueue(items []item) {
+	for _, it := range items {
+		if !it.child.IsZero() && !f.since.IsZero() {
+			if _, ok := f.excluded[it.hash]; ok {
+				f.pruned[it.child] = struct{}{}
+				continue
+			}
+			f.children[it.hash] = append(f.children[it.hash], it.child)
+		}
+
+		if depth, ok := f.seen[it.hash]; ok && (depth == 0 || it.depth != 0 && it.depth <= depth) {
+			continue
+		}
+
+		f.seen[it.hash] = it.depth
+		f.queue = append(f.queue, it)
+	}
+}
+
+// fetch retrieves and writes it unless it is present locally, returning
+// the objects it references.
+func (f *Fetcher) fetch(ctx context.Context, it item) ([]item, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	obj, local, err := f.object(ctx, it)
+	if err != nil || obj == nil {
+		return nil, err
+	}
+
+	if obj.Type() != plumbing.CommitObject {
+		if !local {
+			if err = f.write(obj); err != nil {
+				return nil, err
+			}
+		}
+
+		refs, err := references(obj)
+		if err != nil {
+			return nil, err
+		}
+
+		// The target of a tag is walked the way the tag is.
+		if obj.Type() == plumbing.TagObject {
+			refs[0].depth, refs[0].through = it.depth, it.through
+		}
+
+		return refs, nil
+	}
+
+	var c object.Commit
+	if err = c.Decode(obj); err != nil {
+		return nil, err
+	}
+
+	if !it.child.IsZero() && !f.since.IsZero() && c.Committer.When.Before(f.since) {
+		f.exclude(c.Hash)
+		return nil, nil
+	}
+
+	var refs []item
+	if !local {
+		if err = f.write(obj); err != nil {
+			return nil, err
+		}
+		refs = append(refs, item{hash: c.TreeHash})
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if it.depth == 1 {
+		if len(c.ParentHashes) > 0 {
+			f.cut[c.Hash] = struct{}{}
+		}
+		return refs, nil
+	}
+
+	f.walked[c.Hash] = struct{}{}
+
+	depth := 0
+	if it.depth > 1 {
+		depth = it.depth - 1
+	}
+
+	for _, p := range c.ParentHashes {
+		refs = append(refs, item{hash: p, depth: depth, child: c.Hash, through: depth > 0 || !f.since.IsZero()})
+	}
+
+	return refs, nil
+}
+
+// object returns the object of it and whether it was present locally. It
+// returns a nil object when it is present and needn't be walked.
+func (f *Fetcher) object(ctx context.Context, it item) (plumbing.EncodedObject, bool, error) {
+	f.writeMu.Lock()
+	err := f.storer.HasEncodedObject(it.hash)
+	if err == nil {
+		var obj plumbing.EncodedObject
+		if it.through {
+			obj, err = f.storer.EncodedObject(plumbing.AnyObject, it.hash)
+		}
+		f.writeMu.Unlock()
+
+		return obj, true, err
+	}
+	f.writeMu.Unlock()
+
+	filtered := it.blob && f.filter != nil
+	if filtered {
+		if keep, err := f.keepBlob(ctx, it.hash); err != nil || !keep {
+			return nil, false, err
+		}
+	}
+
+	raw, err := f.provider.Object(ctx, it.hash.String())
+	if err != nil {
+		return nil, false, fmt.Errorf("object %s: %w", it.hash, err)
+	}
+
+	obj, err := ParseLooseObject(it.hash, raw)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if filtered && !f.filter.KeepBlob(obj.Size()) {
+		return nil, false, nil
+	}
+
+	f.progress.Add(1, int64(len(raw)))
+
+	return obj, false, nil
+}
+
+// keepBlob checks the blob h against the filter, as far as possible
+// without transferring it.
+func (f *Fetcher) keepBlob(ctx context.Context, h plumbing.Hash) (bool, error) {
+	if f.filter.BlobLimit < 0 {
+		return false, nil
+	}
+
+	sizer, ok := f.provider.(ObjectSizer)
+	if !ok {
+		return true, nil
+	}
+
+	size, err := sizer.ObjectSize(ctx, h.String())
+	if err != nil {
+		return false, fmt.Errorf("object %s: %w", h, err)
+	}
+
+	return f.filter.KeepBlob(size), nil
+}
+
+func (f *Fetcher) write(obj plumbing.EncodedObject) error {
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	_, err := f.storer.SetEncodedObject(obj)
+	return err
+}
+
+// exclude leaves out the commit h, making the commits that led to it
+// shallow.
+func (f *Fetcher) exclude(h plumbing.Hash) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.excluded[h] = struct{}{}
+	for _, child := range f.children[h] {
+		f.pruned[child] = struct{}{}
+	}
+}
+
+// ParseLooseObject decodes raw, the loose form of the object h, checking
+// that its content hashes to h.
+func ParseLooseObject(h plumbing.Hash, raw []byte) (plumbing.EncodedObject, error) {
+	i := bytes.IndexByte(raw, 0)
+	if i < 0 {
+		return nil, fmt.Errorf("object %s: missing header", h)
+	}
+
+	header := strings.SplitN(string(raw[:i]), " ", 2)
+	if len(header) != 2 {
+		return nil, fmt.Errorf("object %s: invalid header %q", h, raw[:i])
+	}
+
+	t, err := plumbing.ParseObjectType(header[0])
+	if err != nil {
+		return nil, fmt.Errorf("object %s: %w", h, err)
+	}
+
+	content := raw[i+1:]
+	if size, err := strconv.Atoi(header[1]); err != nil || size != len(content) {
+		return nil, fmt.Errorf("object %s: invalid size %q", h, header[1])
+	}
+
+	obj := &plumbing.MemoryObject{}
+	obj.SetType(t)
+	if _, err = obj.Write(content); err != nil {
+		return nil, err
+	}
+
+	if obj.Hash() != h {
+		return nil, fmt.Errorf("object %s: content hashes to %s", h, obj.Hash())
+	}
+
+	return obj, nil
+}
+
+// references returns the objects a tree or a tag points at. Submodule
+// commits live in other repositories and are left out.
+func references(obj plumbing.EncodedObject) ([]item, error) {
+	switch obj.Type() {
+	case plumbing.TreeObject:
+		var t object.Tree
+		if err := t.Decode(obj); err != nil {
+			return nil, err
+		}
+
+		refs := make([]item, 0, len(t.Entries))
+		for _, e := range t.Entries {
+			if e.Mode != filemode.Submodule {
+				refs = append(refs, item{hash: e.Hash, blob: e.Mode.IsFile()})
+			}
+		}
+
+		return refs, nil
+	case plumbing.TagObject:
+		var t object.Tag
+		if err := t.Decode(obj); err != nil {
+			return nil, err
+		}
+
+		return []item{{hash: t.Target}}, nil
+	default:
+		return nil, nil
+	}
+}
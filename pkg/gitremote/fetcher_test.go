@@ -0,0 +1,326 @@
+package gitremote
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/stretchr/testify/assert"
+)
+
+// mapProvider serves the objects of a storage, counting the requests.
+type mapProvider struct {
+	source *memory.Storage
+	mu     sync.Mutex
+	calls  map[string]int
+}
+
+func (m *mapProvider) Object(ctx context.Context, sha string) ([]byte, error) {
+	m.mu.Lock()
+	m.calls[sha]++
+	m.mu.Unlock()
+
+	obj, err := m.source.EncodedObject(plumbing.AnyObject, plumbing.NewHash(sha))
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := obj.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(fmt.Sprintf("%s %d\x00", obj.Type(), obj.Size())), content...), nil
+}
+
+func storeObject(t *testing.T, s *memory.Storage, o interface {
+	Encode(plumbing.EncodedObject) error
+}) plumbing.Hash {
+	obj := s.NewEncodedObject()
+	assert.NoError(t, o.Encode(obj))
+
+	h, err := s.SetEncodedObject(obj)
+	assert.NoError(t, err)
+
+	return h
+}
+
+// history stores two commits sharing a tree, and a tag of the last one.
+func history(t *testing.T) (s *memory.Storage, tip, tag plumbing.Hash) {
+	s = memory.NewStorage()
+
+	blob := &plumbing.MemoryObject{}
+	blob.SetType(plumbing.BlobObject)
+	_, err := blob.Write([]byte("hello\n"))
+	assert.NoError(t, err)
+	blobHash, err := s.SetEncodedObject(blob)
+	assert.NoError(t, err)
+
+	tree := storeObject(t, s, &object.Tree{Entries: []object.TreeEntry{
+		{Name: "hello.txt", Mode: filemode.Regular, Hash: blobHash},
+		{Name: "vendor", Mode: filemode.Submodule, Hash: plumbing.NewHash("ada5ec06cbbdc9616a6e4a7cd43a7b078936368e")},
+	}})
+
+	sig := object.Signature{Name: "a", Email: "a@example.com", When: time.Unix(0, 0).UTC()}
+	first := storeObject(t, s, &object.Commit{Author: sig, Committer: sig, Message: "first\n", TreeHash: tree})
+	tip = storeObject(t, s, &object.Commit{
+		Author:       sig,
+		Committer:    sig,
+		Message:      "second\n",
+		TreeHash:     tree,
+		ParentHashes: []plumbing.Hash{first},
+	})
+	tag = storeObject(t, s, &object.Tag{Name: "v1", Tagger: sig, Message: "v1\n", TargetType: plumbing.CommitObject, Target: tip})
+
+	return s, tip, tag
+}
+
+func TestFetcher(t *testing.T) {
+	source, tip, tag := history(t)
+	provider := &mapProvider{source: source, calls: map[string]int{}}
+
+	dst := memory.NewStorage()
+	f := NewFetcher(provider, dst, 4, nil)
+
+	if !assert.NoError(t, f.Fetch(context.Background(), tip, tag, tip)) {
+		return
+	}
+	assert.Len(t, dst.Objects, 5, "blob, tree, two commits and the tag")
+	for sha, n := range provider.calls {
+		assert.Equal(t, 1, n, sha)
+	}
+
+	assert.NoError(t, NewFetcher(provider, dst, 4, nil).Fetch(context.Background(), tag))
+	assert.Equal(t, 1, provider.calls[tag.String()], "objects present locally aren't fetched")
+}
+
+func TestFetcher_Errors(t *testing.T) {
+	source, tip, _ := history(t)
+
+	missing := NewFetcher(&mapProvider{source: memory.NewStorage(), calls: map[string]int{}}, memory.NewStorage(), 2, nil)
+	assert.ErrorIs(t, missing.Fetch(context.Background(), tip), plumbing.ErrObjectNotFound)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	canceled := NewFetcher(&mapProvider{source: source, calls: map[string]int{}}, memory.NewStorage(), 2, nil)
+	assert.ErrorIs(t, canceled.Fetch(ctx, tip), context.Canceled)
+}
+
+func TestParseLooseObject(t *testing.T) {
+	hello := plumbing.ComputeHash(plumbing.BlobObject, []byte("hello\n"))
+
+	tests := []struct {
+		name    string
+		raw     string
+		wantErr bool
+	}{
+		{name: "blob", raw: "blob 6\x00hello\n"},
+		{name: "missing header", raw: "hello\n", wantErr: true},
+		{name: "invalid type", raw: "blurb 6\x00hello\n", wantErr: true},
+		{name: "invalid size", raw: "blob 7\x00hello\n", wantErr: true},
+		{name: "corrupt", raw: "blob 6\x00jello\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj, err := ParseLooseObject(hello, []byte(tt.raw))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, plumbing.BlobObject, obj.Type())
+			assert.Equal(t, hello, obj.Hash())
+		})
+	}
+}
+
+// chain stores n commits of a single file, a day apart, and returns them
+// from the oldest.
+func chain(t *testing.T, n int) (*memory.Storage, []plumbing.Hash) {
+	s := memory.NewStorage()
+
+	var commits []plumbing.Hash
+	for i := 0; i < n; i++ {
+		blob := &plumbing.MemoryObject{}
+		blob.SetType(plumbing.BlobObject)
+		_, err := blob.Write([]byte(fmt.Sprintf("version %d\n", i)))
+		assert.NoError(t, err)
+		blobHash, err := s.SetEncodedObject(blob)
+		assert.NoError(t, err)
+
+		tree := storeObject(t, s, &object.Tree{Entries: []object.TreeEntry{
+			{Name: "version.txt", Mode: filemode.Regular, Hash: blobHash},
+		}})
+
+		var parents []plumbing.Hash
+		if i > 0 {
+			parents = commits[i-1 : i]
+		}
+
+		sig := object.Signature{Name: "a", Email: "a@example.com", When: time.Unix(int64(i)*86400, 0).UTC()}
+		commits = append(commits, storeObject(t, s, &object.Commit{
+			Author:       sig,
+			Committer:    sig,
+			Message:      fmt.Sprintf("commit %d\n", i),
+			TreeHash:     tree,
+			ParentHashes: parents,
+		}))
+	}
+
+	return s, commits
+}
+
+func TestFetcher_Shallow(t *testing.T) {
+	source, commits := chain(t, 5)
+	tip := commits[4]
+	provider := &mapProvider{source: source, calls: map[string]int{}}
+	dst := memory.NewStorage()
+	ctx := context.Background()
+
+	f := NewFetcher(provider, dst, 4, nil)
+	f.SetShallow(2, time.Time{})
+	assert.NoError(t, f.Fetch(ctx, tip))
+	shallow := f.Shallow(nil)
+	assert.Equal(t, []plumbing.Hash{commits[3]}, shallow)
+	assert.Len(t, dst.Commits, 2)
+
+	f = NewFetcher(provider, dst, 4, nil)
+	f.SetShallow(3, time.Time{})
+	assert.NoError(t, f.Fetch(ctx, tip))
+	shallow = f.Shallow(shallow)
+	assert.Equal(t, []plumbing.Hash{commits[2]}, shallow, "a larger depth deepens")
+	assert.Len(t, dst.Commits, 3)
+
+	f = NewFetcher(provider, dst, 4, nil)
+	assert.NoError(t, f.Deepen(ctx, 1, shallow...))
+	shallow = f.Shallow(shallow)
+	assert.Equal(t, []plumbing.Hash{commits[1]}, shallow, "deepen by one")
+
+	f = NewFetcher(provider, dst, 4, nil)
+	assert.NoError(t, f.Fetch(ctx, tip))
+	assert.Equal(t, shallow, f.Shallow(shallow), "a fetch without depth keeps the repository shallow")
+
+	f = NewFetcher(provider, dst, 4, nil)
+	assert.NoError(t, f.Deepen(ctx, 0, shallow...))
+	assert.Empty(t, f.Shallow(shallow), "unshallow")
+	assert.Len(t, dst.Commits, 5)
+}
+
+func TestFetcher_ShallowSince(t *testing.T) {
+	source, commits := chain(t, 5)
+	dst := memory.NewStorage()
+
+	f := NewFetcher(&mapProvider{source: source, calls: map[string]int{}}, dst, 4, nil)
+	f.SetShallow(0, time.Unix(2*86400, 0))
+	assert.NoError(t, f.Fetch(context.Background(), commits[4]))
+	assert.Equal(t, []plumbing.Hash{commits[2]}, f.Shallow(nil))
+	assert.Len(t, dst.Commits, 3)
+	assert.NotContains(t, dst.Commits, commits[1])
+}
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    int64
+		wantErr bool
+	}{
+		{spec: "blob:none", want: -1},
+		{spec: "blob:limit=0", want: 0},
+		{spec: "blob:limit=512k", want: 512 << 10},
+		{spec: "blob:limit=lots", wantErr: true},
+		{spec: "tree:0", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := ParseFilter(tt.spec)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got.BlobLimit)
+		})
+	}
+}
+
+func TestFetcher_Filter(t *testing.T) {
+	source, commits := chain(t, 3)
+	provider := &mapProvider{source: source, calls: map[string]int{}}
+	ctx := context.Background()
+
+	for _, tt := range []struct {
+		spec  string
+		blobs int
+	}{
+		{spec: "blob:none", blobs: 0},
+		{spec: "blob:limit=9", blobs: 0},
+		{spec: "blob:limit=10", blobs: 3},
+	} {
+		t.Run(tt.spec, func(t *testing.T) {
+			filter, err := ParseFilter(tt.spec)
+			assert.NoError(t, err)
+
+			dst := memory.NewStorage()
+			f := NewFetcher(provider, dst, 4, nil)
+			f.SetFilter(filter)
+
+			assert.NoError(t, f.Fetch(ctx, commits[2]))
+			assert.Len(t, dst.Commits, 3)
+			assert.Len(t, dst.Trees, 3)
+			assert.Len(t, dst.Blobs, tt.blobs)
+		})
+	}
+
+	dst := memory.NewStorage()
+	f := NewFetcher(provider, dst, 4, nil)
+	f.SetFilter(&Filter{BlobLimit: -1})
+
+	blob := plumbing.ComputeHash(plumbing.BlobObject, []byte("version 0\n"))
+	assert.NoError(t, f.Fetch(ctx, blob))
+	assert.Contains(t, dst.Blobs, blob, "blobs asked for aren't filtered")
+}
+
+func TestPromisorStorer(t *testing.T) {
+	source, commits := chain(t, 2)
+	dir := t.TempDir()
+	repo := filesystem.NewStorage(osfs.New(dir), cache.NewObjectLRUDefault())
+
+	s := newPromisorStorer(repo)
+	f := NewFetcher(&mapProvider{source: source, calls: map[string]int{}}, s, 2, nil)
+	f.SetFilter(&Filter{BlobLimit: -1})
+
+	assert.NoError(t, f.Fetch(context.Background(), commits[1]))
+	assert.NoError(t, s.writePack())
+
+	promisors, err := filepath.Glob(filepath.Join(dir, "objects", "pack", "pack-*.promisor"))
+	assert.NoError(t, err)
+	assert.Len(t, promisors, 1)
+
+	for _, c := range commits {
+		assert.NoError(t, repo.HasEncodedObject(c))
+	}
+	assert.Empty(t, s.fetched.Objects)
+	assert.NoError(t, s.writePack(), "nothing left to write")
+}
@@ -0,0 +1,40 @@
+package gitremote
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/peerforge/peerforge/pkg/gitfmt"
+)
+
+const filterBlobLimit = "blob:limit="
+
+// Filter is a partial clone filter, as given to git's --filter. Only the
+// blob:none and blob:limit=<n> forms are supported.
+type Filter struct {
+	// BlobLimit is the size above which blobs are left out, -1 when they
+	// all are.
+	BlobLimit int64
+}
+
+// ParseFilter parses a filter spec such as "blob:none" or "blob:limit=1m".
+func ParseFilter(spec string) (*Filter, error) {
+	switch {
+	case spec == "blob:none":
+		return &Filter{BlobLimit: -1}, nil
+	case strings.HasPrefix(spec, filterBlobLimit):
+		limit, err := gitfmt.ParseSize(strings.TrimPrefix(spec, filterBlobLimit))
+		if err != nil {
+			return nil, fmt.Errorf("filter %q: %w", spec, err)
+		}
+
+		return &Filter{BlobLimit: limit}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported filter %q", spec)
+}
+
+// KeepBlob reports whether a blob of size bytes passes the filter.
+func (f *Filter) KeepBlob(size int64) bool {
+	return f.BlobLimit >= 0 && size <= f.BlobLimit
+}
@@ -1,15 +1,63 @@
 package gitremote
 
-//
-//import (
-//	ipldgit "github.com/drgomesp/git-remote-ipldprime/core"
-//)
-//
-//type ProtocolHandler interface {
-//	Initialize(tracker *ipldgit.Tracker, repo *git.Repository) error
-//	Capabilities() string
-//	List(forPush bool) ([]string, error)
-//	Push(localRef string, remoteRef string) (string, error)
-//	ProvideBlock(identifier string, tracker *ipldgit.Tracker) ([]byte, error)
-//	Finish() error
-//}
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	ipldgit "github.com/drgomesp/git-remote-ipldprime/core"
+	"github.com/go-git/go-git/v5"
+)
+
+// ErrNonFastForward is returned by a ProtocolHandler when a push would
+// move a remote ref to a commit that does not descend from its current tip.
+var ErrNonFastForward = errors.New("non-fast-forward")
+
+// ErrAlreadyExists is returned by a ProtocolHandler when a push without
+// force would move an existing tag.
+var ErrAlreadyExists = errors.New("already exists")
+
+// ErrRefNotFound is returned by a ProtocolHandler when asked to delete a
+// ref the remote doesn't have.
+var ErrRefNotFound = errors.New("remote ref does not exist")
+
+// ErrAtomicPushFailed is reported for the refs of an atomic push that were
+// accepted but dropped because another ref in the batch was rejected.
+var ErrAtomicPushFailed = errors.New("atomic push failed")
+
+// RefError is a failure scoped to a single ref of a push batch. Protocol
+// reports it to git as "error <ref> <why>" and carries on with the rest of
+// the batch, while any other error from a ProtocolHandler aborts the session.
+type RefError struct {
+	Ref string
+	Err error
+}
+
+func (e *RefError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Ref, e.Err)
+}
+
+func (e *RefError) Unwrap() error {
+	return e.Err
+}
+
+type ProtocolHandler interface {
+	// Initialize is handed the session Options, which keep being updated
+	// as git sends "option" commands.
+	Initialize(tracker *ipldgit.Tracker, repo *git.Repository, options *Options) error
+	Capabilities() string
+	List(forPush bool) ([]string, error)
+	// Push uploads localRef and stages remoteRef to point at it. Unless
+	// force is set, the update must be a fast-forward of the current remote
+	// tip. Rejections of this ref alone are returned as a *RefError.
+	Push(ctx context.Context, localRef string, remoteRef string, force bool) (string, error)
+	// Delete stages the removal of remoteRef. Rejections of this ref alone
+	// are returned as a *RefError.
+	Delete(ctx context.Context, remoteRef string) error
+	// Commit applies every update staged in the current push batch at once.
+	Commit(ctx context.Context) error
+	// Rollback discards the updates staged in the current push batch.
+	Rollback()
+	ProvideBlock(identifier string, tracker *ipldgit.Tracker) ([]byte, error)
+	Finish() error
+}
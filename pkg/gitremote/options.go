@@ -0,0 +1,156 @@
+package gitremote
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	OptVerbosity      = "verbosity"
+	OptProgress       = "progress"
+	OptDryRun         = "dry-run"
+	OptDepth          = "depth"
+	OptDeepenSince    = "deepen-since"
+	OptDeepenRelative = "deepen-relative"
+	OptFilter         = "filter"
+	OptFollowTags     = "followtags"
+	OptAtomic         = "atomic"
+	OptPushOption     = "push-option"
+)
+
+// InfiniteDepth is the depth git asks for to unshallow a repository.
+const InfiniteDepth = 0x7fffffff
+
+// ErrUnsupportedOption is returned by Options.Set for options the helper
+// doesn't know about, which git is told about with "unsupported".
+var ErrUnsupportedOption = errors.New("unsupported option")
+
+// Options holds the settings git sent through "option" commands during
+// a session. A ProtocolHandler receives a pointer to it on Initialize and
+// reads it as commands arrive.
+type Options struct {
+	// Verbosity is 0 for -q, 1 by default and grows with every -v.
+	Verbosity int
+	Progress  bool
+	DryRun    bool
+	// Depth is the number of commits to fetch from each tip, zero for the
+	// whole history. With DeepenRelative, it counts from the current
+	// shallow commits instead.
+	Depth          int
+	DeepenSince    time.Time
+	DeepenRelative bool
+	// Filter is set for partial clones and the fetches that follow them.
+	Filter      *Filter
+	FollowTags  bool
+	Atomic      bool
+	PushOptions []string
+}
+
+func NewOptions() *Options {
+	return &Options{Verbosity: 1}
+}
+
+// ShowProgress reports whether git asked for progress output and isn't
+// running quietly.
+func (o *Options) ShowProgress() bool {
+	return o.Progress && o.Verbosity > 0
+}
+
+// NewProgress returns a Progress drawn on stderr, or nil when ShowProgress
+// is false.
+func (o *Options) NewProgress(title string, total int) *Progress {
+	if !o.ShowProgress() {
+		return nil
+	}
+
+	return NewProgress(os.Stderr, title, total)
+}
+
+// Set applies a single "option <name> <value>" command.
+func (o *Options) Set(name string, value string) (err error) {
+	switch name {
+	case OptVerbosity:
+		o.Verbosity, err = strconv.Atoi(value)
+	case OptProgress:
+		o.Progress, err = parseBool(value)
+	case OptDryRun:
+		o.DryRun, err = parseBool(value)
+	case OptDepth:
+		if o.Depth, err = strconv.Atoi(value); err == nil && o.Depth < 0 {
+			err = fmt.Errorf("negative depth")
+		}
+	case OptDeepenSince:
+		o.DeepenSince, err = parseDate(value)
+	case OptDeepenRelative:
+		o.DeepenRelative, err = parseBool(value)
+	case OptFilter:
+		o.Filter, err = ParseFilter(value)
+	case OptFollowTags:
+		o.FollowTags, err = parseBool(value)
+	case OptAtomic:
+		o.Atomic, err = parseBool(value)
+	case OptPushOption:
+		var opt string
+		if opt, err = unquote(value); err == nil {
+			o.PushOptions = append(o.PushOptions, opt)
+		}
+	default:
+		return ErrUnsupportedOption
+	}
+
+	if err != nil {
+		return fmt.Errorf("invalid value %q for option %s", value, name)
+	}
+
+	return nil
+}
+
+func parseBool(value string) (bool, error) {
+	switch value {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	default:
+		return false, fmt.Errorf("not a boolean: %q", value)
+	}
+}
+
+// dateLayouts are the forms of --shallow-since dates understood besides
+// Unix timestamps.
+var dateLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"}
+
+// parseDate parses the date of a --shallow-since, passed on as the user
+// wrote it. Only absolute dates are supported, not git's "2 weeks ago".
+func parseDate(value string) (time.Time, error) {
+	value, err := unquote(value)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if ts, err := strconv.ParseInt(strings.TrimPrefix(value, "@"), 10, 64); err == nil {
+		return time.Unix(ts, 0), nil
+	}
+
+	for _, layout := range dateLayouts {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("unsupported date %q", value)
+}
+
+// unquote undoes the C-style quoting git applies to string option values
+// containing special characters.
+func unquote(value string) (string, error) {
+	if !strings.HasPrefix(value, `"`) {
+		return value, nil
+	}
+
+	return strconv.Unquote(value)
+}
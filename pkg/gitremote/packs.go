@@ -0,0 +1,94 @@
+package gitremote
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/rs/zerolog/log"
+)
+
+// PackProvider is implemented by handlers storing the history of a
+// repository as packfiles. Fetches then download each pack whole, in one
+// request, before walking the objects they still miss one by one.
+type PackProvider interface {
+	// Packs returns the IDs of the packfiles of the repository, in the
+	// order they were pushed.
+	Packs(ctx context.Context) ([]string, error)
+	// Pack opens the packfile id.
+	Pack(ctx context.Context, id string) (io.ReadCloser, error)
+}
+
+// packKeyPrefix prefixes the tracker keys of the packs already downloaded.
+const packKeyPrefix = "packs/"
+
+// fetchPacks downloads the packs of provider the local repository doesn't
+// have yet into its object storage, where git indexes them. It does
+// nothing when the storage can't take packfiles.
+func (p *Protocol) fetchPacks(ctx context.Context, provider PackProvider) error {
+	pw, ok := p.repo.Storer.(storer.PackfileWriter)
+	if !ok {
+		return nil
+	}
+
+	ids, err := provider.Packs(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		done, err := p.tracker.Get(packKeyPrefix + id)
+		if err != nil {
+			return err
+		}
+		if len(done) > 0 {
+			continue
+		}
+
+		log.Debug().Msgf("downloading pack %s", id)
+
+		if err = p.fetchPack(ctx, provider, pw, id); err != nil {
+			return fmt.Errorf("pack %s: %w", id, err)
+		}
+
+		if err = p.tracker.Set(packKeyPrefix+id, []byte(id)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *Protocol) fetchPack(ctx context.Context, provider PackProvider, pw storer.PackfileWriter, id string) error {
+	r, err := provider.Pack(ctx, id)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := pw.PackfileWriter()
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(w, &progressReader{r: r, progress: p.progress}); err != nil {
+		_ = w.Close()
+		return err
+	}
+
+	return w.Close()
+}
+
+// progressReader reports the bytes read from r to progress.
+type progressReader struct {
+	r        io.Reader
+	progress *Progress
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.progress.Add(0, int64(n))
+
+	return n, err
+}
@@ -0,0 +1,65 @@
+package gitremote
+
+import (
+	"context"
+	"runtime"
+	"sync"
+)
+
+// DefaultConcurrency is the number of objects a helper transfers at once
+// when it isn't configured otherwise.
+var DefaultConcurrency = runtime.NumCPU()
+
+// ForEach calls fn for every index below count, running at most n calls
+// at once. It stops handing out work at the first error, or when ctx is
+// done, and returns that error once the calls already running are over.
+func ForEach(ctx context.Context, n int, count int, fn func(ctx context.Context, i int) error) error {
+	if n < 1 {
+		n = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg    sync.WaitGroup
+		once  sync.Once
+		first error
+		work  = make(chan int)
+	)
+
+	for w := 0; w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := range work {
+				if err := fn(ctx, i); err != nil {
+					once.Do(func() {
+						first = err
+						cancel()
+					})
+					return
+				}
+			}
+		}()
+	}
+
+feed:
+	for i := 0; i < count; i++ {
+		select {
+		case work <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+
+	close(work)
+	wg.Wait()
+
+	if first != nil {
+		return first
+	}
+
+	return ctx.Err()
+}
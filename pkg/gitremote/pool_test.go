@@ -0,0 +1,74 @@
+package gitremote
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForEach(t *testing.T) {
+	errFailed := errors.New("failed")
+
+	tests := []struct {
+		name  string
+		n     int
+		count int
+		fail  int
+		err   error
+	}{
+		{name: "serial", n: 1, count: 10, fail: -1},
+		{name: "parallel", n: 4, count: 100, fail: -1},
+		{name: "no workers", n: 0, count: 3, fail: -1},
+		{name: "nothing to do", n: 4, count: 0, fail: -1},
+		{name: "error", n: 4, count: 100, fail: 7, err: errFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls, running, peak int32
+
+			err := ForEach(context.Background(), tt.n, tt.count, func(ctx context.Context, i int) error {
+				atomic.AddInt32(&calls, 1)
+				r := atomic.AddInt32(&running, 1)
+				defer atomic.AddInt32(&running, -1)
+
+				for p := atomic.LoadInt32(&peak); r > p; p = atomic.LoadInt32(&peak) {
+					if atomic.CompareAndSwapInt32(&peak, p, r) {
+						break
+					}
+				}
+
+				if i == tt.fail {
+					return errFailed
+				}
+
+				return nil
+			})
+
+			limit := tt.n
+			if limit < 1 {
+				limit = 1
+			}
+
+			assert.ErrorIs(t, err, tt.err)
+			assert.LessOrEqual(t, int(peak), limit)
+			if tt.err == nil {
+				assert.Equal(t, tt.count, int(calls))
+			}
+		})
+	}
+}
+
+func TestForEach_Canceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := ForEach(ctx, 2, 10, func(ctx context.Context, i int) error {
+		return nil
+	})
+
+	assert.ErrorIs(t, err, context.Canceled)
+}
@@ -0,0 +1,78 @@
+package gitremote
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// progressInterval throttles redraws of a Progress line.
+const progressInterval = 250 * time.Millisecond
+
+// Progress draws a git-style progress line, e.g.
+// "Writing objects:  42% (420/1000), 12.00 MiB", redrawing it in place
+// as work is reported. A nil *Progress is valid and prints nothing.
+type Progress struct {
+	mu    sync.Mutex
+	w     io.Writer
+	title string
+	total int
+	count int
+	bytes int64
+	drawn time.Time
+}
+
+// NewProgress starts a progress line for a task of total items. A total of
+// zero means the size of the task isn't known in advance.
+func NewProgress(w io.Writer, title string, total int) *Progress {
+	return &Progress{w: w, title: title, total: total}
+}
+
+// Add records n more items amounting to size bytes.
+func (p *Progress) Add(n int, size int64) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.count += n
+	p.bytes += size
+
+	if time.Since(p.drawn) >= progressInterval {
+		p.draw("\r")
+		p.drawn = time.Now()
+	}
+}
+
+// Done prints the final state of the progress line.
+func (p *Progress) Done() {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.draw(", done.\n")
+}
+
+func (p *Progress) draw(end string) {
+	var line string
+	if p.total > 0 {
+		line = fmt.Sprintf(
+			"%s: %3d%% (%d/%d), %s",
+			p.title,
+			p.count*100/p.total,
+			p.count,
+			p.total,
+			FormatBytes(p.bytes),
+		)
+	} else {
+		line = fmt.Sprintf("%s: %d, %s", p.title, p.count, FormatBytes(p.bytes))
+	}
+
+	_, _ = fmt.Fprintf(p.w, "%s%s", line, end)
+}
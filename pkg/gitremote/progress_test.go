@@ -0,0 +1,99 @@
+package gitremote
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProgress(t *testing.T) {
+	type add struct {
+		n    int
+		size int64
+	}
+
+	tests := []struct {
+		name  string
+		title string
+		total int
+		adds  []add
+		want  string
+	}{
+		{
+			name:  "known total",
+			title: "Writing objects",
+			total: 4,
+			adds:  []add{{1, 512}, {2, 1024}},
+			want:  "Writing objects:  75% (3/4), 1.50 KiB, done.\n",
+		},
+		{
+			name:  "complete",
+			title: "Writing objects",
+			total: 2,
+			adds:  []add{{2, 3 << 20}},
+			want:  "Writing objects: 100% (2/2), 3.00 MiB, done.\n",
+		},
+		{
+			name:  "unknown total",
+			title: "Receiving objects",
+			adds:  []add{{5, 100}, {1, 20}},
+			want:  "Receiving objects: 6, 120 bytes, done.\n",
+		},
+		{
+			name:  "nothing done",
+			title: "Receiving objects",
+			want:  "Receiving objects: 0, 0 bytes, done.\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			p := NewProgress(&buf, tt.title, tt.total)
+
+			for _, a := range tt.adds {
+				p.Add(a.n, a.size)
+			}
+			p.Done()
+
+			out := buf.String()
+			if len(tt.adds) > 0 {
+				assert.True(t, strings.HasPrefix(out, tt.title+": "), "the first Add draws the line")
+			}
+
+			lines := strings.Split(out, "\r")
+			assert.Equal(t, tt.want, lines[len(lines)-1])
+		})
+	}
+}
+
+func TestProgress_Nil(t *testing.T) {
+	var p *Progress
+
+	assert.NotPanics(t, func() {
+		p.Add(1, 10)
+		p.Done()
+	})
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{n: 0, want: "0 bytes"},
+		{n: 1023, want: "1023 bytes"},
+		{n: 1024, want: "1.00 KiB"},
+		{n: 1536, want: "1.50 KiB"},
+		{n: 5 << 20, want: "5.00 MiB"},
+		{n: 3 << 30, want: "3.00 GiB"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			assert.Equal(t, tt.want, FormatBytes(tt.n))
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package gitremote
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+// packWindow is the number of objects the encoder of promisor packs looks
+// back at for deltas.
+const packWindow = 10
+
+// promisorStorer gathers the objects of a filtered fetch in memory, reading
+// through to the repository, and writes them as a promisor pack: git only
+// tolerates the objects a filter left out when they are referenced from
+// such packs, and fetches them lazily from the same remote when needed.
+type promisorStorer struct {
+	storer.EncodedObjectStorer
+	fetched *memory.Storage
+}
+
+func newPromisorStorer(s storer.EncodedObjectStorer) *promisorStorer {
+	return &promisorStorer{EncodedObjectStorer: s, fetched: memory.NewStorage()}
+}
+
+func (s *promisorStorer) SetEncodedObject(obj plumbing.EncodedObject) (plumbing.Hash, error) {
+	return s.fetched.SetEncodedObject(obj)
+}
+
+func (s *promisorStorer) HasEncodedObject(h plumbing.Hash) error {
+	if s.fetched.HasEncodedObject(h) == nil {
+		return nil
+	}
+
+	return s.EncodedObjectStorer.HasEncodedObject(h)
+}
+
+func (s *promisorStorer) EncodedObject(t plumbing.ObjectType, h plumbing.Hash) (plumbing.EncodedObject, error) {
+	if obj, err := s.fetched.EncodedObject(t, h); err == nil {
+		return obj, nil
+	}
+
+	return s.EncodedObjectStorer.EncodedObject(t, h)
+}
+
+// writePack writes the objects gathered so far as a pack of the repository,
+// along with the .promisor file marking it.
+func (s *promisorStorer) writePack() error {
+	if len(s.fetched.Objects) == 0 {
+		return nil
+	}
+
+	fs, ok := s.EncodedObjectStorer.(*filesystem.Storage)
+	if !ok {
+		return fmt.Errorf("partial clones need a repository on disk")
+	}
+
+	hashes := make([]plumbing.Hash, 0, len(s.fetched.Objects))
+	for h := range s.fetched.Objects {
+		hashes = append(hashes, h)
+	}
+
+	w, err := fs.PackfileWriter()
+	if err != nil {
+		return err
+	}
+
+	checksum, err := packfile.NewEncoder(w, s.fetched, false).Encode(hashes, packWindow)
+	if err != nil {
+		_ = w.Close()
+		return err
+	}
+
+	if err = w.Close(); err != nil {
+		return err
+	}
+
+	s.fetched = memory.NewStorage()
+
+	name := fmt.Sprintf("pack-%s.promisor", checksum)
+
+	return os.WriteFile(filepath.Join(fs.Filesystem().Root(), "objects", "pack", name), nil, 0444)
+}
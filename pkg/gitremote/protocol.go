@@ -4,35 +4,57 @@ import (
 	"bufio"
 	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
 
-	gitremote "github.com/drgomesp/git-remote-ipldprime"
 	ipldgit "github.com/drgomesp/git-remote-ipldprime/core"
 	"github.com/go-git/go-git/v5"
-	"github.com/rs/zerolog"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/storage/filesystem"
 	"github.com/rs/zerolog/log"
-)
 
-func init() {
-	zerolog.SetGlobalLevel(zerolog.TraceLevel)
-	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
-}
+	"github.com/peerforge/peerforge/pkg/gitfmt"
+)
 
 type Protocol struct {
 	prefix   string
 	localDir string
 
 	tracker  *ipldgit.Tracker
-	handler  gitremote.ProtocolHandler
+	handler  ProtocolHandler
 	repo     *git.Repository
-	lazyWork []func() (string, error)
+	options  *Options
+	updates  []refUpdate
+	fetches  []fetchRequest
+	progress *Progress
+	// listing is the last ref listing sent to git, used to follow tags.
+	listing []string
+
+	// OnVerbosity, when set, is called with the verbosity git asks for,
+	// for instance to adjust the log level.
+	OnVerbosity func(verbosity int)
+}
+
+// fetchRequest is a queued "fetch <sha> <ref>" command.
+type fetchRequest struct {
+	sha string
+	ref string
 }
 
-func NewProtocol(prefix string, tracker *ipldgit.Tracker, handler gitremote.ProtocolHandler) (*Protocol, error) {
+// refUpdate is a queued push or delete of a single remote ref.
+type refUpdate struct {
+	dst   string
+	stage func() error
+}
+
+func NewProtocol(prefix string, tracker *ipldgit.Tracker, handler ProtocolHandler) (*Protocol, error) {
 	log.Info().Msgf("GIT_DIR=%s", os.Getenv("GIT_DIR"))
 
 	localDir, err := GetLocalDir()
@@ -50,7 +72,8 @@ func NewProtocol(prefix string, tracker *ipldgit.Tracker, handler gitremote.Prot
 		}
 	}
 
-	if err = handler.Initialize(tracker, repo); err != nil {
+	options := NewOptions()
+	if err = handler.Initialize(tracker, repo, options); err != nil {
 		return nil, err
 	}
 
@@ -60,7 +83,7 @@ func NewProtocol(prefix string, tracker *ipldgit.Tracker, handler gitremote.Prot
 		repo:     repo,
 		localDir: localDir,
 		tracker:  tracker,
-		lazyWork: make([]func() (string, error), 0),
+		options:  options,
 	}, nil
 }
 
@@ -78,22 +101,40 @@ loop:
 		log.Info().Msgf("< %s", command)
 		switch {
 		case command == "capabilities":
-			p.Printf(w, "push\n")
-			p.Printf(w, "fetch\n")
-			p.Printf(w, "\n")
+			p.Printf(w, "%s\n\n", p.handler.Capabilities())
 		case strings.HasPrefix(command, "list"):
 			list, err := p.handler.List(strings.HasPrefix(command, "list for-push"))
 			if err != nil {
 				log.Err(err).Send()
 				return err
 			}
+			p.listing = list
 			for _, e := range list {
 				p.Printf(w, "%s\n", e)
 			}
 			p.Printf(w, "\n")
+		case strings.HasPrefix(command, "option "):
+			p.Printf(w, "%s\n", p.option(command[7:]))
 		case strings.HasPrefix(command, "push "):
-			refs := strings.Split(command[5:], ":")
-			p.push(refs[0], refs[1], false)
+			refspec := command[5:]
+			force := strings.HasPrefix(refspec, "+")
+			refs := strings.SplitN(strings.TrimPrefix(refspec, "+"), ":", 2)
+			if len(refs) != 2 {
+				return fmt.Errorf("invalid push refspec %q", refspec)
+			}
+			if refs[0] == "" {
+				p.delete(refs[1])
+			} else {
+				p.push(refs[0], refs[1], force)
+			}
+		case strings.HasPrefix(command, CmdStatelessConnect+" "):
+			connected, err := p.statelessConnect(reader, w, command[len(CmdStatelessConnect)+1:])
+			if err != nil {
+				return err
+			}
+			if connected {
+				break loop
+			}
 		case strings.HasPrefix(command, "fetch "):
 			parts := strings.Split(command, " ")
 			if parts[1] != "0000000000000000000000000000000000000000" {
@@ -103,15 +144,13 @@ loop:
 			fallthrough
 		case command == "\n":
 			log.Info().Msg("Processing tasks")
-			for _, task := range p.lazyWork {
-				resp, err := task()
-				if err != nil {
-					return err
-				}
-				p.Printf(w, "%s", resp)
+			if err := p.processUpdates(w); err != nil {
+				return err
+			}
+			if err := p.processFetches(); err != nil {
+				return err
 			}
 			p.Printf(w, "\n")
-			p.lazyWork = nil
 			break loop
 		default:
 			return fmt.Errorf("received unknown command %q", command)
@@ -121,39 +160,399 @@ loop:
 	return p.handler.Finish()
 }
 
+// statelessConnect answers a "stateless-connect <service>" command. Unless
+// the handler falls back, which git is told with "fallback", the rest of
+// the session is proxied to the node serving the repository and true is
+// returned once git is done.
+func (p *Protocol) statelessConnect(r io.Reader, w io.Writer, service string) (bool, error) {
+	var url string
+	if c, ok := p.handler.(StatelessConnector); ok {
+		var err error
+		if url, err = c.ServiceURL(service); err != nil {
+			return false, err
+		}
+	}
+
+	if url == "" {
+		p.Printf(w, "fallback\n")
+		return false, nil
+	}
+
+	log.Info().Msgf("connecting %s to %s", service, url)
+	p.Printf(w, "\n")
+
+	return true, StatelessConnect(http.DefaultClient, url, service, r, w)
+}
+
+// option applies an "option <name> <value>" command and returns the reply
+// git expects: "ok", "unsupported" or "error <why>".
+func (p *Protocol) option(args string) string {
+	parts := strings.SplitN(args, " ", 2)
+	if len(parts) != 2 {
+		return fmt.Sprintf("error invalid option %q", args)
+	}
+
+	switch parts[0] {
+	case OptDepth, OptDeepenSince, OptDeepenRelative, OptFilter:
+		// Shallow and partial fetches need the Fetcher.
+		if _, ok := p.handler.(ObjectProvider); !ok {
+			return "unsupported"
+		}
+	}
+
+	err := p.options.Set(parts[0], parts[1])
+	if errors.Is(err, ErrUnsupportedOption) {
+		return "unsupported"
+	}
+	if err != nil {
+		return fmt.Sprintf("error %v", err)
+	}
+
+	if parts[0] == OptVerbosity && p.OnVerbosity != nil {
+		p.OnVerbosity(p.options.Verbosity)
+	}
+
+	return "ok"
+}
+
+// Options returns the settings git sent during the session so far.
+func (p *Protocol) Options() *Options {
+	return p.options
+}
+
 func (p *Protocol) push(src string, dst string, force bool) {
-	_ = force // TODO: handle force push
+	p.updates = append(p.updates, refUpdate{dst: dst, stage: func() error {
+		_, err := p.handler.Push(context.Background(), src, dst, force)
+		return err
+	}})
+}
+
+func (p *Protocol) delete(dst string) {
+	p.updates = append(p.updates, refUpdate{dst: dst, stage: func() error {
+		return p.handler.Delete(context.Background(), dst)
+	}})
+}
+
+// processUpdates stages every queued ref update with the handler, commits
+// the accepted ones and reports a status line per ref. With the atomic
+// option set, a single rejected ref rolls back the whole batch.
+func (p *Protocol) processUpdates(w io.Writer) error {
+	if len(p.updates) == 0 {
+		return nil
+	}
+
+	updates := p.updates
+	p.updates = nil
+
+	errs := make([]error, len(updates))
+	rejected := false
+	for i, u := range updates {
+		var refErr *RefError
+		err := u.stage()
+		if err != nil && !errors.As(err, &refErr) {
+			p.handler.Rollback()
+			return err
+		}
+
+		errs[i] = err
+		rejected = rejected || err != nil
+	}
+
+	if p.options.Atomic && rejected {
+		p.handler.Rollback()
+		for i, u := range updates {
+			if errs[i] == nil {
+				errs[i] = &RefError{Ref: u.dst, Err: ErrAtomicPushFailed}
+			}
+		}
+	} else if err := p.handler.Commit(context.Background()); err != nil {
+		return err
+	}
 
-	p.lazyWork = append(p.lazyWork, func() (string, error) {
-		done, err := p.handler.Push(context.Background(), src, dst)
+	for i, u := range updates {
+		status, err := refStatus(u.dst, errs[i])
 		if err != nil {
-			return "", err
+			return err
 		}
+		p.Printf(w, "%s", status)
+	}
 
-		return fmt.Sprintf("ok %s\n", done), nil
-	})
+	return nil
+}
+
+// refStatus formats the status line git expects for a pushed ref. Ref-level
+// failures become "error" lines, anything else is returned as fatal.
+func refStatus(dst string, err error) (string, error) {
+	var refErr *RefError
+	if errors.As(err, &refErr) {
+		log.Warn().Err(err).Msg("ref rejected")
+		return fmt.Sprintf("error %s %v\n", dst, refErr.Err), nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("ok %s\n", dst), nil
 }
 
 func (p *Protocol) fetch(sha string, ref string) {
-	p.lazyWork = append(p.lazyWork, func() (string, error) {
-		if sha == "0000000000000000000000000000000000000000" {
-			return "", nil
+	p.fetches = append(p.fetches, fetchRequest{sha: sha, ref: ref})
+}
+
+// processFetches fetches the objects of every queued fetch command, and
+// the tags to follow, then records each ref in the tracker.
+//
+// Handlers implementing ObjectProvider get a single Fetcher for the batch,
+// so objects shared by several refs are only retrieved once, and support
+// shallow and partial fetches. The others are walked with ipldgit.Fetch,
+// one object at a time. The objects of a partial fetch are written as a
+// promisor pack, the others one by one as they arrive.
+func (p *Protocol) processFetches() error {
+	if len(p.fetches) == 0 {
+		return nil
+	}
+
+	fetches := p.fetches
+	p.fetches = nil
+
+	p.progress = p.options.NewProgress("Receiving objects", 0)
+
+	var (
+		fetch   = p.fetchHashes
+		fetcher *Fetcher
+		shallow []plumbing.Hash
+	)
+
+	if provider, ok := p.handler.(ObjectProvider); ok {
+		var (
+			s        storer.EncodedObjectStorer = p.repo.Storer
+			promisor *promisorStorer
+		)
+		if p.options.Filter != nil {
+			promisor = newPromisorStorer(p.repo.Storer)
+			s = promisor
+		}
+
+		fetcher = NewFetcher(provider, s, DefaultConcurrency, p.progress)
+		fetcher.SetFilter(p.options.Filter)
+
+		var err error
+		if shallow, err = p.repo.Storer.Shallow(); err != nil {
+			return err
+		}
+
+		if err = p.deepen(fetcher, shallow); err != nil {
+			return fmt.Errorf("command fetch: %v", err)
+		}
+
+		// Whole packs hold complete history, so they're only worth it
+		// when git wants all of it.
+		packs, ok := p.handler.(PackProvider)
+		if ok && p.options.Filter == nil && p.options.Depth == 0 && p.options.DeepenSince.IsZero() && len(shallow) == 0 {
+			if err = p.fetchPacks(context.Background(), packs); err != nil {
+				return fmt.Errorf("command fetch: %v", err)
+			}
+		}
+
+		fetch = func(shas []string) error {
+			hashes := make([]plumbing.Hash, len(shas))
+			for i, sha := range shas {
+				hashes[i] = plumbing.NewHash(sha)
+			}
+
+			if err := fetcher.Fetch(context.Background(), hashes...); err != nil {
+				return err
+			}
+
+			if promisor != nil {
+				return promisor.writePack()
+			}
+
+			return nil
+		}
+	}
+
+	if err := p.fetchRefs(fetch, fetches); err != nil {
+		return fmt.Errorf("command fetch: %v", err)
+	}
+
+	if p.options.FollowTags {
+		if err := p.followTags(fetch); err != nil {
+			return err
+		}
+	}
+
+	if fetcher != nil {
+		if err := p.updateShallow(fetcher, shallow); err != nil {
+			return err
 		}
+	}
+
+	p.progress.Done()
+
+	return nil
+}
+
+// deepen sets up f for the depth git asked for. With --deepen, or when
+// unshallowing, the shallow commits of the repository are deepened first.
+func (p *Protocol) deepen(f *Fetcher, shallow []plumbing.Hash) error {
+	depth := p.options.Depth
+	switch {
+	case depth >= InfiniteDepth:
+		return f.Deepen(context.Background(), 0, shallow...)
+	case p.options.DeepenRelative:
+		return f.Deepen(context.Background(), depth, shallow...)
+	}
+
+	f.SetShallow(depth, p.options.DeepenSince)
+
+	return nil
+}
+
+// updateShallow writes the shallow commits of the repository after a fetch
+// with f, when they changed. The shallow file is removed once there are
+// none left, as git takes its mere presence for a shallow repository.
+func (p *Protocol) updateShallow(f *Fetcher, before []plumbing.Hash) error {
+	after := f.Shallow(before)
+	if sameHashes(after, before) {
+		return nil
+	}
+
+	log.Debug().Msgf("%d shallow commits", len(after))
+
+	if fs, ok := p.repo.Storer.(*filesystem.Storage); ok && len(after) == 0 {
+		err := os.Remove(filepath.Join(fs.Filesystem().Root(), "shallow"))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+
+		return err
+	}
+
+	return p.repo.Storer.SetShallow(after)
+}
+
+// sameHashes reports whether a and b hold the same hashes, in any order.
+func sameHashes(a, b []plumbing.Hash) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	set := make(map[plumbing.Hash]struct{}, len(a))
+	for _, h := range a {
+		set[h] = struct{}{}
+	}
+
+	for _, h := range b {
+		if _, ok := set[h]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// fetchRefs fetches the objects of refs at once and records their values.
+func (p *Protocol) fetchRefs(fetch func(shas []string) error, refs []fetchRequest) error {
+	shas := make([]string, len(refs))
+	for i, r := range refs {
+		shas[i] = r.sha
+	}
+
+	if err := fetch(shas); err != nil {
+		return err
+	}
 
-		fetch := p.NewFetch()
-		err := fetch.FetchHash(sha)
+	for _, r := range refs {
+		raw, err := hex.DecodeString(r.sha)
 		if err != nil {
-			return "", fmt.Errorf("command fetch: %v", err)
+			return err
+		}
+
+		if err = p.tracker.Set(r.ref, raw); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fetchHashes fetches shas through ipldgit.Fetch, one after the other.
+func (p *Protocol) fetchHashes(shas []string) error {
+	for _, sha := range shas {
+		if err := p.fetchHash(sha); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fetchHash fetches the object sha through ipldgit.Fetch. An annotated tag
+// is peeled and the objects it points at fetched along.
+func (p *Protocol) fetchHash(sha string) error {
+	for target := sha; ; {
+		if err := p.NewFetch().FetchHash(target); err != nil {
+			return err
 		}
 
-		sha, err := hex.DecodeString(sha)
+		tag, err := p.repo.TagObject(plumbing.NewHash(target))
+		if err == plumbing.ErrObjectNotFound {
+			return nil
+		}
 		if err != nil {
-			return "", fmt.Errorf("fetch: %v", err)
+			return err
 		}
 
-		p.tracker.Set(ref, sha)
-		return "", nil
-	})
+		target = tag.Target.String()
+	}
+}
+
+// followTags fetches the annotated tags of the last listing that peel to
+// objects present locally, so git doesn't need another round to get them.
+func (p *Protocol) followTags(fetch func(shas []string) error) error {
+	var tags []fetchRequest
+
+	refs := parseListing(p.listing)
+	for name, sha := range refs {
+		peeled, ok := refs[name+gitfmt.PeeledSuffix]
+		if !ok || !p.hasObject(peeled) || p.hasObject(sha) {
+			continue
+		}
+
+		log.Debug().Msgf("following tag %s", name)
+		tags = append(tags, fetchRequest{sha: sha, ref: name})
+	}
+
+	if len(tags) == 0 {
+		return nil
+	}
+
+	if err := p.fetchRefs(fetch, tags); err != nil {
+		return fmt.Errorf("follow tags: %v", err)
+	}
+
+	return nil
+}
+
+func (p *Protocol) hasObject(sha string) bool {
+	return p.repo.Storer.HasEncodedObject(plumbing.NewHash(sha)) == nil
+}
+
+// parseListing maps the ref names of a listing to their values, leaving
+// out symrefs.
+func parseListing(listing []string) map[string]string {
+	refs := make(map[string]string, len(listing))
+	for _, e := range listing {
+		parts := strings.SplitN(e, " ", 2)
+		if len(parts) != 2 || strings.HasPrefix(parts[0], "@") {
+			continue
+		}
+
+		refs[parts[1]] = parts[0]
+	}
+
+	return refs
 }
 
 func (p *Protocol) Printf(w io.Writer, format string, a ...interface{}) {
@@ -162,6 +561,17 @@ func (p *Protocol) Printf(w io.Writer, format string, a ...interface{}) {
 	}
 }
 
+// NewFetch returns a fetch that reports the blocks it receives on the
+// progress of the current batch.
 func (p *Protocol) NewFetch() *ipldgit.Fetch {
-	return ipldgit.NewFetch(p.localDir, p.tracker, p.handler.ProvideBlock)
+	provide := func(identifier string, tracker *ipldgit.Tracker) ([]byte, error) {
+		data, err := p.handler.ProvideBlock(identifier, tracker)
+		if err == nil {
+			p.progress.Add(1, int64(len(data)))
+		}
+
+		return data, err
+	}
+
+	return ipldgit.NewFetch(p.localDir, p.tracker, provide)
 }
@@ -5,12 +5,14 @@ import (
 	"context"
 	"io"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
-	gitremote "github.com/drgomesp/git-remote-ipldprime"
 	ipldgit "github.com/drgomesp/git-remote-ipldprime/core"
 	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/stretchr/testify/assert"
@@ -28,7 +30,7 @@ func init() {
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 }
 
-var _ gitremote.ProtocolHandler = &handlerMock{}
+var _ ProtocolHandler = &handlerMock{}
 
 type handlerMock struct {
 	mock.Mock
@@ -39,7 +41,7 @@ func (h *handlerMock) ProvideBlock(identifier string, tracker *ipldgit.Tracker)
 	return nil, nil
 }
 
-func (h *handlerMock) Initialize(tracker *ipldgit.Tracker, repo *git.Repository) error {
+func (h *handlerMock) Initialize(tracker *ipldgit.Tracker, repo *git.Repository, options *Options) error {
 	return nil
 }
 
@@ -56,11 +58,25 @@ func (h *handlerMock) List(forPush bool) ([]string, error) {
 	return args.Get(0).([]string), args.Error(1)
 }
 
-func (h *handlerMock) Push(ctx context.Context, localRef string, remoteRef string) (string, error) {
-	args := h.Called(localRef, remoteRef)
+func (h *handlerMock) Push(ctx context.Context, localRef string, remoteRef string, force bool) (string, error) {
+	args := h.Called(localRef, remoteRef, force)
 	return args.String(0), args.Error(1)
 }
 
+func (h *handlerMock) Delete(ctx context.Context, remoteRef string) error {
+	args := h.Called(remoteRef)
+	return args.Error(0)
+}
+
+func (h *handlerMock) Commit(ctx context.Context) error {
+	args := h.Called()
+	return args.Error(0)
+}
+
+func (h *handlerMock) Rollback() {
+	h.Called()
+}
+
 func (h *handlerMock) Fetch(sha, ref string) error {
 	args := h.Called(sha, ref)
 	return args.Error(0)
@@ -83,6 +99,142 @@ func Test_Protocol(t *testing.T) {
 			in:   "capabilities",
 			out:  DefaultCapabilities,
 		},
+		{
+			name: "option",
+			in:   "option verbosity 0\noption dry-run true",
+			out:  "ok\nok",
+		},
+		{
+			name: "option unsupported",
+			in:   "option cas refs/heads/main",
+			out:  "unsupported",
+		},
+		{
+			name: "option invalid",
+			in:   "option progress maybe",
+			out:  `error invalid value "maybe" for option progress`,
+		},
+		{
+			name: "option depth unsupported",
+			in:   "option depth 1",
+			out:  "unsupported",
+		},
+		{
+			name: "stateless-connect fallback",
+			in:   "stateless-connect git-upload-pack",
+			out:  "fallback",
+		},
+		{
+			name: "list",
+			in:   "list",
+			out: "@refs/heads/main HEAD\n" +
+				"ada5ec06cbbdc9616a6e4a7cd43a7b078936368e refs/heads/main\n" +
+				"0f1e7f9b47c3d5e51e8c6a4b6a4c3e7d1c2b3a40 refs/tags/v1\n" +
+				"ada5ec06cbbdc9616a6e4a7cd43a7b078936368e refs/tags/v1^{}",
+			mock: func(m *handlerMock) {
+				m.On("List", false).Return([]string{
+					"@refs/heads/main HEAD",
+					"ada5ec06cbbdc9616a6e4a7cd43a7b078936368e refs/heads/main",
+					"0f1e7f9b47c3d5e51e8c6a4b6a4c3e7d1c2b3a40 refs/tags/v1",
+					"ada5ec06cbbdc9616a6e4a7cd43a7b078936368e refs/tags/v1^{}",
+				}, nil)
+			},
+		},
+		{
+			name: "push",
+			in:   "push refs/heads/main:refs/heads/main\n",
+			out:  "ok refs/heads/main",
+			mock: func(m *handlerMock) {
+				m.On("Push", "refs/heads/main", "refs/heads/main", false).
+					Return("refs/heads/main", nil)
+				m.On("Commit").Return(nil)
+			},
+		},
+		{
+			name: "push forced",
+			in:   "push +refs/heads/feature:refs/heads/feature\n",
+			out:  "ok refs/heads/feature",
+			mock: func(m *handlerMock) {
+				m.On("Push", "refs/heads/feature", "refs/heads/feature", true).
+					Return("refs/heads/feature", nil)
+				m.On("Commit").Return(nil)
+			},
+		},
+		{
+			name: "push non-fast-forward",
+			in:   "push refs/heads/feature:refs/heads/feature\n",
+			out:  "error refs/heads/feature non-fast-forward",
+			mock: func(m *handlerMock) {
+				m.On("Push", "refs/heads/feature", "refs/heads/feature", false).
+					Return("", &RefError{Ref: "refs/heads/feature", Err: ErrNonFastForward})
+				m.On("Commit").Return(nil)
+			},
+		},
+		{
+			name: "push partial failure",
+			in:   "push refs/heads/a:refs/heads/a\npush refs/heads/b:refs/heads/b\n",
+			out:  "error refs/heads/a non-fast-forward\nok refs/heads/b",
+			mock: func(m *handlerMock) {
+				m.On("Push", "refs/heads/a", "refs/heads/a", false).
+					Return("", &RefError{Ref: "refs/heads/a", Err: ErrNonFastForward})
+				m.On("Push", "refs/heads/b", "refs/heads/b", false).
+					Return("refs/heads/b", nil)
+				m.On("Commit").Return(nil)
+			},
+		},
+		{
+			name: "push tag already exists",
+			in:   "push refs/tags/v1:refs/tags/v1\n",
+			out:  "error refs/tags/v1 already exists",
+			mock: func(m *handlerMock) {
+				m.On("Push", "refs/tags/v1", "refs/tags/v1", false).
+					Return("", &RefError{Ref: "refs/tags/v1", Err: ErrAlreadyExists})
+				m.On("Commit").Return(nil)
+			},
+		},
+		{
+			name: "delete",
+			in:   "push :refs/heads/old\n",
+			out:  "ok refs/heads/old",
+			mock: func(m *handlerMock) {
+				m.On("Delete", "refs/heads/old").Return(nil)
+				m.On("Commit").Return(nil)
+			},
+		},
+		{
+			name: "delete missing",
+			in:   "push :refs/heads/gone\n",
+			out:  "error refs/heads/gone remote ref does not exist",
+			mock: func(m *handlerMock) {
+				m.On("Delete", "refs/heads/gone").
+					Return(&RefError{Ref: "refs/heads/gone", Err: ErrRefNotFound})
+				m.On("Commit").Return(nil)
+			},
+		},
+		{
+			name: "push atomic",
+			in:   "option atomic true\npush refs/heads/a:refs/heads/a\npush refs/tags/v1:refs/tags/v1\n",
+			out:  "ok\nok refs/heads/a\nok refs/tags/v1",
+			mock: func(m *handlerMock) {
+				m.On("Push", "refs/heads/a", "refs/heads/a", false).
+					Return("refs/heads/a", nil)
+				m.On("Push", "refs/tags/v1", "refs/tags/v1", false).
+					Return("refs/tags/v1", nil)
+				m.On("Commit").Return(nil)
+			},
+		},
+		{
+			name: "push atomic rejected",
+			in:   "option atomic true\npush refs/heads/a:refs/heads/a\npush refs/tags/v1:refs/tags/v1\n",
+			out:  "ok\nerror refs/heads/a atomic push failed\nerror refs/tags/v1 non-fast-forward",
+			mock: func(m *handlerMock) {
+				m.On("Push", "refs/heads/a", "refs/heads/a", false).
+					Return("refs/heads/a", nil)
+				m.On("Push", "refs/tags/v1", "refs/tags/v1", false).
+					Return("", &RefError{Ref: "refs/tags/v1", Err: ErrNonFastForward})
+				m.On("Rollback").Return()
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -95,6 +247,7 @@ func Test_Protocol(t *testing.T) {
 			proto := &Protocol{
 				prefix:  "origin",
 				handler: handlerMock,
+				options: NewOptions(),
 			}
 
 			reader := strings.NewReader(tt.in + "\n")
@@ -113,3 +266,117 @@ func Test_Protocol(t *testing.T) {
 		})
 	}
 }
+
+func Test_parseDate(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Time
+		wantErr bool
+	}{
+		{value: "1700000000", want: time.Unix(1700000000, 0)},
+		{value: "@1700000000", want: time.Unix(1700000000, 0)},
+		{value: "2023-11-14T22:13:20Z", want: time.Unix(1700000000, 0)},
+		{value: `"2023-11-14 22:13:20"`, want: time.Date(2023, 11, 14, 22, 13, 20, 0, time.Local)},
+		{value: "2023-11-14", want: time.Date(2023, 11, 14, 0, 0, 0, 0, time.Local)},
+		{value: "2 weeks ago", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseDate(tt.value)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.True(t, tt.want.Equal(got), "got %s", got)
+		})
+	}
+}
+
+func Test_parseListing(t *testing.T) {
+	got := parseListing([]string{
+		"@refs/heads/main HEAD",
+		"ada5ec06cbbdc9616a6e4a7cd43a7b078936368e refs/heads/main",
+		"0f1e7f9b47c3d5e51e8c6a4b6a4c3e7d1c2b3a40 refs/tags/v1",
+		"ada5ec06cbbdc9616a6e4a7cd43a7b078936368e refs/tags/v1^{}",
+	})
+
+	assert.Equal(t, map[string]string{
+		"refs/heads/main": "ada5ec06cbbdc9616a6e4a7cd43a7b078936368e",
+		"refs/tags/v1":    "0f1e7f9b47c3d5e51e8c6a4b6a4c3e7d1c2b3a40",
+		"refs/tags/v1^{}": "ada5ec06cbbdc9616a6e4a7cd43a7b078936368e",
+	}, got)
+}
+
+func TestProtocol_OnVerbosity(t *testing.T) {
+	var got []int
+	proto := &Protocol{
+		prefix:      "origin",
+		handler:     new(handlerMock),
+		options:     NewOptions(),
+		OnVerbosity: func(verbosity int) { got = append(got, verbosity) },
+	}
+
+	var out bytes.Buffer
+	assert.NoError(t, proto.Run(strings.NewReader("option verbosity 2\noption progress true\noption verbosity 0\n\n"), &out))
+	assert.Equal(t, []int{2, 0}, got)
+}
+
+// providerMock is a handler serving the objects of a storage to the Fetcher.
+type providerMock struct {
+	handlerMock
+	*mapProvider
+}
+
+func TestProtocol_LazyFetch(t *testing.T) {
+	source, commits := chain(t, 2)
+	provider := &providerMock{mapProvider: &mapProvider{source: source, calls: map[string]int{}}}
+	dir := t.TempDir()
+	_, err := git.PlainInit(dir, true)
+	assert.NoError(t, err)
+
+	tracker, err := ipldgit.NewTracker()
+	assert.NoError(t, err)
+
+	run := func(in string) *git.Repository {
+		repo, err := git.PlainOpen(dir)
+		assert.NoError(t, err)
+
+		proto := &Protocol{
+			prefix:  "origin",
+			tracker: tracker,
+			handler: provider,
+			repo:    repo,
+			options: NewOptions(),
+		}
+
+		var out bytes.Buffer
+		assert.NoError(t, proto.Run(strings.NewReader(in), &out))
+		assert.Equal(t, "ok\n\n", out.String())
+
+		return repo
+	}
+
+	repo := run("option filter blob:none\nfetch " + commits[1].String() + " refs/heads/master\n\n")
+
+	tip, err := repo.CommitObject(commits[1])
+	assert.NoError(t, err)
+	tree, err := repo.TreeObject(tip.TreeHash)
+	assert.NoError(t, err)
+	blob := tree.Entries[0].Hash
+	assert.ErrorIs(t, repo.Storer.HasEncodedObject(blob), plumbing.ErrObjectNotFound, "left out by the filter")
+	assert.Zero(t, provider.calls[blob.String()])
+
+	// git fetches the objects missing from a partial clone one by one, by
+	// id, keeping the filter of the clone.
+	repo = run("option filter blob:none\nfetch " + blob.String() + " " + blob.String() + "\n\n")
+
+	assert.NoError(t, repo.Storer.HasEncodedObject(blob))
+	assert.Equal(t, 1, provider.calls[blob.String()])
+
+	promisors, err := filepath.Glob(filepath.Join(dir, "objects", "pack", "pack-*.promisor"))
+	assert.NoError(t, err)
+	assert.Len(t, promisors, 2)
+}
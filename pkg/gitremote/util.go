@@ -46,3 +46,19 @@ func HexFromCid(cid cid.Cid) (string, error) {
 	// TODO: validate length
 	return hash.HexString()[4:], nil
 }
+
+// FormatBytes renders n the way git reports transfer sizes, e.g. "12.00 MiB".
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d bytes", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.2f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
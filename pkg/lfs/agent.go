@@ -0,0 +1,179 @@
+// Package lfs implements the git-lfs custom transfer protocol, moving LFS
+// objects in and out of a Storage instead of an LFS server.
+//
+// Git LFS runs the agent once per transfer batch and talks to it with one
+// JSON message per line: an init event, then upload or download events,
+// and finally terminate.
+package lfs
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	EventInit      = "init"
+	EventUpload    = "upload"
+	EventDownload  = "download"
+	EventTerminate = "terminate"
+	EventProgress  = "progress"
+	EventComplete  = "complete"
+)
+
+// Storage keeps LFS objects by oid, the hex SHA-256 of their content.
+type Storage interface {
+	// Upload stores the object at path under oid.
+	Upload(ctx context.Context, oid string, path string) error
+	// Download writes the content of the object oid to w.
+	Download(ctx context.Context, oid string, w io.Writer) error
+}
+
+// Init is the first message of a session. Remote is the git remote name,
+// or its URL when git lfs was given one.
+type Init struct {
+	Operation string `json:"operation"`
+	Remote    string `json:"remote"`
+}
+
+// Opener returns the Storage of a session.
+type Opener func(init Init) (Storage, error)
+
+type request struct {
+	Event     string `json:"event"`
+	Operation string `json:"operation,omitempty"`
+	Remote    string `json:"remote,omitempty"`
+	Oid       string `json:"oid,omitempty"`
+	Size      int64  `json:"size,omitempty"`
+	Path      string `json:"path,omitempty"`
+}
+
+type response struct {
+	Event          string    `json:"event,omitempty"`
+	Oid            string    `json:"oid,omitempty"`
+	Path           string    `json:"path,omitempty"`
+	BytesSoFar     int64     `json:"bytesSoFar,omitempty"`
+	BytesSinceLast int64     `json:"bytesSinceLast,omitempty"`
+	Error          *errorMsg `json:"error,omitempty"`
+}
+
+type errorMsg struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// ErrNotInitialized is reported for transfers requested before init.
+var ErrNotInitialized = errors.New("transfer before init")
+
+type Agent struct {
+	open    Opener
+	storage Storage
+	// tmpDir receives downloaded objects, os.TempDir() when empty.
+	tmpDir string
+}
+
+func NewAgent(open Opener) *Agent {
+	return &Agent{open: open}
+}
+
+// Run serves a session until git lfs sends terminate or closes r.
+func (a *Agent) Run(r io.Reader, w io.Writer) error {
+	ctx := context.Background()
+	enc := json.NewEncoder(w)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var req request
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			return fmt.Errorf("lfs: invalid message %q: %w", scanner.Text(), err)
+		}
+
+		log.Debug().Str("event", req.Event).Str("oid", req.Oid).Msg("lfs <")
+
+		var resp *response
+		switch req.Event {
+		case EventInit:
+			resp = a.init(req)
+		case EventUpload:
+			resp = a.upload(ctx, req, enc)
+		case EventDownload:
+			resp = a.download(ctx, req)
+		case EventTerminate:
+			return nil
+		default:
+			return fmt.Errorf("lfs: unknown event %q", req.Event)
+		}
+
+		if err := enc.Encode(resp); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+func (a *Agent) init(req request) *response {
+	storage, err := a.open(Init{Operation: req.Operation, Remote: req.Remote})
+	if err != nil {
+		return &response{Error: &errorMsg{Code: 1, Message: err.Error()}}
+	}
+
+	a.storage = storage
+
+	return &response{}
+}
+
+func (a *Agent) upload(ctx context.Context, req request, enc *json.Encoder) *response {
+	if a.storage == nil {
+		return failed(req.Oid, ErrNotInitialized)
+	}
+
+	if err := a.storage.Upload(ctx, req.Oid, req.Path); err != nil {
+		return failed(req.Oid, err)
+	}
+
+	if err := enc.Encode(&response{
+		Event:          EventProgress,
+		Oid:            req.Oid,
+		BytesSoFar:     req.Size,
+		BytesSinceLast: req.Size,
+	}); err != nil {
+		return failed(req.Oid, err)
+	}
+
+	return &response{Event: EventComplete, Oid: req.Oid}
+}
+
+func (a *Agent) download(ctx context.Context, req request) *response {
+	if a.storage == nil {
+		return failed(req.Oid, ErrNotInitialized)
+	}
+
+	f, err := os.CreateTemp(a.tmpDir, "pfg-lfs-"+req.Oid+"-*")
+	if err != nil {
+		return failed(req.Oid, err)
+	}
+
+	err = a.storage.Download(ctx, req.Oid, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return failed(req.Oid, err)
+	}
+
+	return &response{Event: EventComplete, Oid: req.Oid, Path: f.Name()}
+}
+
+func failed(oid string, err error) *response {
+	log.Warn().Err(err).Str("oid", oid).Msg("lfs transfer failed")
+	return &response{Event: EventComplete, Oid: oid, Error: &errorMsg{Code: 2, Message: err.Error()}}
+}
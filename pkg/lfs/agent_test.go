@@ -0,0 +1,122 @@
+package lfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type memStorage map[string][]byte
+
+func (m memStorage) Upload(ctx context.Context, oid string, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	m[oid] = data
+	return nil
+}
+
+func (m memStorage) Download(ctx context.Context, oid string, w io.Writer) error {
+	data, ok := m[oid]
+	if !ok {
+		return errors.New("object not found")
+	}
+
+	_, err := w.Write(data)
+	return err
+}
+
+func Test_Agent(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "object")
+	assert.NoError(t, os.WriteFile(file, []byte("large asset"), 0644))
+
+	tests := []struct {
+		name    string
+		in      []string
+		out     []string
+		openErr error
+	}{
+		{
+			name: "upload",
+			in: []string{
+				`{"event":"init","operation":"upload","remote":"origin"}`,
+				`{"event":"upload","oid":"a1","size":11,"path":"` + file + `"}`,
+				`{"event":"terminate"}`,
+			},
+			out: []string{
+				`{}`,
+				`{"event":"progress","oid":"a1","bytesSoFar":11,"bytesSinceLast":11}`,
+				`{"event":"complete","oid":"a1"}`,
+			},
+		},
+		{
+			name: "download missing",
+			in: []string{
+				`{"event":"init","operation":"download","remote":"origin"}`,
+				`{"event":"download","oid":"b2","size":3}`,
+			},
+			out: []string{
+				`{}`,
+				`{"event":"complete","oid":"b2","error":{"code":2,"message":"object not found"}}`,
+			},
+		},
+		{
+			name:    "init failure",
+			in:      []string{`{"event":"init","operation":"download","remote":"nowhere"}`},
+			out:     []string{`{"error":{"code":1,"message":"no such remote"}}`},
+			openErr: errors.New("no such remote"),
+		},
+		{
+			name: "transfer before init",
+			in:   []string{`{"event":"download","oid":"c3","size":3}`},
+			out:  []string{`{"event":"complete","oid":"c3","error":{"code":2,"message":"transfer before init"}}`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := memStorage{}
+			agent := NewAgent(func(init Init) (Storage, error) {
+				return storage, tt.openErr
+			})
+
+			var w bytes.Buffer
+			assert.NoError(t, agent.Run(strings.NewReader(strings.Join(tt.in, "\n")+"\n"), &w))
+			assert.Equal(t, strings.Join(tt.out, "\n"), strings.TrimSpace(w.String()))
+		})
+	}
+}
+
+func Test_AgentDownload(t *testing.T) {
+	agent := NewAgent(func(init Init) (Storage, error) {
+		return memStorage{"d4": []byte("content")}, nil
+	})
+	agent.tmpDir = t.TempDir()
+
+	var w bytes.Buffer
+	in := `{"event":"init","operation":"download","remote":"origin"}` + "\n" +
+		`{"event":"download","oid":"d4","size":7}` + "\n"
+	assert.NoError(t, agent.Run(strings.NewReader(in), &w))
+
+	lines := strings.Split(strings.TrimSpace(w.String()), "\n")
+	assert.Len(t, lines, 2)
+
+	matches, err := filepath.Glob(filepath.Join(agent.tmpDir, "pfg-lfs-d4-*"))
+	assert.NoError(t, err)
+	assert.Len(t, matches, 1)
+	assert.Equal(t, `{"event":"complete","oid":"d4","path":"`+matches[0]+`"}`, lines[1])
+
+	data, err := os.ReadFile(matches[0])
+	assert.NoError(t, err)
+	assert.Equal(t, "content", string(data))
+}
@@ -0,0 +1,140 @@
+// Package logging configures the global zerolog logger of PeerForge
+// binaries. Library packages only log through it and never set it up.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	EnvLevel  = "PFG_LOG_LEVEL"
+	EnvFormat = "PFG_LOG_FORMAT"
+	EnvFile   = "PFG_LOG_FILE"
+)
+
+const (
+	FormatConsole = "console"
+	FormatJSON    = "json"
+	FormatOff     = "off"
+)
+
+// DefaultLevel is used when no level is configured and git didn't ask for
+// a specific verbosity.
+const DefaultLevel = zerolog.WarnLevel
+
+var (
+	mu sync.Mutex
+	// followVerbosity is set when no explicit level was configured, so the
+	// level tracks the verbosity git asks for.
+	followVerbosity bool
+)
+
+type Config struct {
+	// Level is a zerolog level name. Empty means DefaultLevel, adjusted to
+	// git's verbosity through SetVerbosity.
+	Level string
+	// Format is one of FormatConsole, FormatJSON or FormatOff.
+	Format string
+	// File receives log output instead of stderr when set.
+	File string
+}
+
+// ConfigFromEnv reads the configuration from PFG_LOG_LEVEL, PFG_LOG_FORMAT
+// and PFG_LOG_FILE.
+func ConfigFromEnv() Config {
+	return Config{
+		Level:  os.Getenv(EnvLevel),
+		Format: os.Getenv(EnvFormat),
+		File:   os.Getenv(EnvFile),
+	}
+}
+
+// Setup points the global logger at the configured output. The returned
+// closer releases the log file, if any.
+func Setup(cfg Config) (io.Closer, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	level := DefaultLevel
+	if cfg.Level != "" {
+		l, err := zerolog.ParseLevel(strings.ToLower(cfg.Level))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %w", EnvLevel, cfg.Level, err)
+		}
+		level = l
+	}
+	followVerbosity = cfg.Level == ""
+
+	var (
+		out    io.Writer = os.Stderr
+		closer io.Closer = nopCloser{}
+	)
+
+	if cfg.File != "" {
+		f, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		out, closer = f, f
+	}
+
+	switch strings.ToLower(cfg.Format) {
+	case "", FormatConsole:
+		log.Logger = zerolog.New(zerolog.ConsoleWriter{Out: out, NoColor: cfg.File != ""}).
+			With().Timestamp().Logger()
+	case FormatJSON:
+		log.Logger = zerolog.New(out).With().Timestamp().Logger()
+	case FormatOff:
+		log.Logger = zerolog.Nop()
+		level = zerolog.Disabled
+		followVerbosity = false
+	default:
+		_ = closer.Close()
+		return nil, fmt.Errorf("invalid %s %q", EnvFormat, cfg.Format)
+	}
+
+	zerolog.SetGlobalLevel(level)
+
+	return closer, nil
+}
+
+// SetVerbosity maps git's verbosity (0 for -q, 1 by default, one more per
+// -v) onto the log level, unless Setup was given an explicit level.
+func SetVerbosity(verbosity int) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if !followVerbosity {
+		return
+	}
+
+	zerolog.SetGlobalLevel(verbosityLevel(verbosity))
+}
+
+func verbosityLevel(verbosity int) zerolog.Level {
+	switch {
+	case verbosity <= 0:
+		return zerolog.ErrorLevel
+	case verbosity == 1:
+		return DefaultLevel
+	case verbosity == 2:
+		return zerolog.InfoLevel
+	case verbosity == 3:
+		return zerolog.DebugLevel
+	default:
+		return zerolog.TraceLevel
+	}
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,59 @@
+package logging
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetup(t *testing.T) {
+	tests := []struct {
+		name      string
+		cfg       Config
+		verbosity int
+		want      zerolog.Level
+		wantErr   bool
+	}{
+		{name: "default", want: DefaultLevel, verbosity: 1},
+		{name: "quiet", want: zerolog.ErrorLevel, verbosity: 0},
+		{name: "verbose", want: zerolog.DebugLevel, verbosity: 3},
+		{name: "explicit level wins", cfg: Config{Level: "trace"}, want: zerolog.TraceLevel, verbosity: 0},
+		{name: "json", cfg: Config{Format: FormatJSON, Level: "info"}, want: zerolog.InfoLevel, verbosity: 1},
+		{name: "off", cfg: Config{Format: FormatOff}, want: zerolog.Disabled, verbosity: 4},
+		{name: "invalid level", cfg: Config{Level: "loud"}, wantErr: true},
+		{name: "invalid format", cfg: Config{Format: "xml"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			closer, err := Setup(tt.cfg)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			defer closer.Close()
+
+			SetVerbosity(tt.verbosity)
+			assert.Equal(t, tt.want, zerolog.GlobalLevel())
+		})
+	}
+}
+
+func TestSetup_File(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "pfg.log")
+
+	closer, err := Setup(Config{Level: "info", Format: FormatJSON, File: file})
+	assert.NoError(t, err)
+
+	log.Info().Msg("to the file")
+	assert.NoError(t, closer.Close())
+
+	data, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"message":"to the file"`)
+}
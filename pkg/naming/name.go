@@ -0,0 +1,46 @@
+// Package naming gives PeerForge repositories mutable names. A name is owned
+// by a key and resolves to the latest repository root its owner published,
+// through signed records kept in a local resolver store.
+package naming
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// DIDPrefix is the method prefix of PeerForge DIDs, "did:pfg:<peer id>".
+const DIDPrefix = "did:pfg:"
+
+var ErrInvalidName = errors.New("invalid repository name")
+
+var repoPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// Name identifies a repository of an owner, written "<owner>/<repo>" where
+// owner is a peer ID or a PeerForge DID.
+type Name struct {
+	Owner peer.ID
+	Repo  string
+}
+
+// ParseName parses "<peer id>/<repo>" or "did:pfg:<peer id>/<repo>".
+func ParseName(s string) (Name, error) {
+	parts := strings.SplitN(strings.TrimPrefix(s, DIDPrefix), "/", 2)
+	if len(parts) != 2 || !repoPattern.MatchString(parts[1]) {
+		return Name{}, fmt.Errorf("%w: %q", ErrInvalidName, s)
+	}
+
+	owner, err := peer.Decode(parts[0])
+	if err != nil {
+		return Name{}, fmt.Errorf("%w: %q: %v", ErrInvalidName, s, err)
+	}
+
+	return Name{Owner: owner, Repo: parts[1]}, nil
+}
+
+func (n Name) String() string {
+	return n.Owner.String() + "/" + n.Repo
+}
@@ -0,0 +1,93 @@
+package naming
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	root1 = "bafyreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku"
+	root2 = "bafyreibvjvcv745gig4mvqs4hctx4zfkono4rjejm2ta6gtyzkqxfjeily"
+)
+
+func TestParseName(t *testing.T) {
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	assert.NoError(t, err)
+	id, err := peer.IDFromPrivateKey(key)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		in      string
+		want    Name
+		wantErr bool
+	}{
+		{name: "peer id", in: id.String() + "/project", want: Name{Owner: id, Repo: "project"}},
+		{name: "did", in: DIDPrefix + id.String() + "/project", want: Name{Owner: id, Repo: "project"}},
+		{name: "cid", in: root1, wantErr: true},
+		{name: "empty repo", in: id.String() + "/", wantErr: true},
+		{name: "nested repo", in: id.String() + "/a/b", wantErr: true},
+		{name: "bad owner", in: "alice/project", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseName(tt.in)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidName)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestResolver(t *testing.T) {
+	r := NewResolver(t.TempDir())
+
+	key, err := r.Identity()
+	assert.NoError(t, err)
+
+	again, err := r.Identity()
+	assert.NoError(t, err)
+	assert.True(t, key.Equals(again), "identity is kept")
+
+	id, err := peer.IDFromPrivateKey(key)
+	assert.NoError(t, err)
+	name := Name{Owner: id, Repo: "project"}
+
+	_, err = r.Resolve(name)
+	assert.ErrorIs(t, err, ErrNameNotFound)
+
+	for _, root := range []string{root1, root2} {
+		assert.NoError(t, r.Publish(key, name, cid.MustParse(root)))
+
+		got, err := r.Resolve(name)
+		assert.NoError(t, err)
+		assert.Equal(t, root, got.String())
+	}
+
+	rec, err := r.record(name)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), rec.Sequence)
+
+	other, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, r.Publish(other, name, cid.MustParse(root1)), ErrNotOwner)
+
+	rec.Root = root1
+	data, err := json.Marshal(rec)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(r.recordPath(name), data, 0600))
+
+	_, err = r.Resolve(name)
+	assert.ErrorIs(t, err, ErrInvalidRecord, "tampered records are rejected")
+}
@@ -0,0 +1,76 @@
+package naming
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/crypto"
+)
+
+var ErrInvalidRecord = errors.New("invalid name record")
+
+// Record binds a name to a repository root. It is signed by the owner of
+// the name, and Sequence grows with every publication so a stale record
+// never replaces a newer one.
+type Record struct {
+	Name      string `json:"name"`
+	Root      string `json:"root"`
+	Sequence  uint64 `json:"sequence"`
+	PublicKey []byte `json:"publicKey"`
+	Signature []byte `json:"signature"`
+}
+
+// NewRecord returns a record of name pointing at root, signed with key.
+func NewRecord(key crypto.PrivKey, name Name, root cid.Cid, seq uint64) (*Record, error) {
+	if !name.Owner.MatchesPrivateKey(key) {
+		return nil, fmt.Errorf("%w: %s", ErrNotOwner, name)
+	}
+
+	pub, err := crypto.MarshalPublicKey(key.GetPublic())
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Record{Name: name.String(), Root: root.String(), Sequence: seq, PublicKey: pub}
+	if r.Signature, err = key.Sign(r.signedData()); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Verify checks that r was signed by the owner of its name and returns the
+// root it points at.
+func (r *Record) Verify() (cid.Cid, error) {
+	name, err := ParseName(r.Name)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	pub, err := crypto.UnmarshalPublicKey(r.PublicKey)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("%w: %v", ErrInvalidRecord, err)
+	}
+
+	if !name.Owner.MatchesPublicKey(pub) {
+		return cid.Undef, fmt.Errorf("%w: %s isn't signed by its owner", ErrInvalidRecord, r.Name)
+	}
+
+	ok, err := pub.Verify(r.signedData(), r.Signature)
+	if err != nil || !ok {
+		return cid.Undef, fmt.Errorf("%w: bad signature for %s", ErrInvalidRecord, r.Name)
+	}
+
+	root, err := cid.Decode(r.Root)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("%w: %v", ErrInvalidRecord, err)
+	}
+
+	return root, nil
+}
+
+func (r *Record) signedData() []byte {
+	return []byte("pfg-name-record\n" + r.Name + "\n" + r.Root + "\n" + strconv.FormatUint(r.Sequence, 10))
+}
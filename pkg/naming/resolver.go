@@ -0,0 +1,163 @@
+package naming
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/crypto"
+)
+
+// EnvHome overrides DefaultDir.
+const EnvHome = "PFG_HOME"
+
+const (
+	identityFile = "identity.key"
+	namesDir     = "names"
+)
+
+var (
+	ErrNameNotFound = errors.New("name not found")
+	ErrNotOwner     = errors.New("not the owner of the name")
+)
+
+// DefaultDir returns $PFG_HOME, or ~/.peerforge when it isn't set.
+func DefaultDir() (string, error) {
+	if dir := os.Getenv(EnvHome); dir != "" {
+		return dir, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, ".peerforge"), nil
+}
+
+// Resolver keeps name records and the local identity key under a directory.
+type Resolver struct {
+	dir string
+}
+
+func NewResolver(dir string) *Resolver {
+	return &Resolver{dir: dir}
+}
+
+// Resolve returns the root name points at, after checking the record was
+// signed by the owner of the name.
+func (r *Resolver) Resolve(name Name) (cid.Cid, error) {
+	rec, err := r.record(name)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	return rec.Verify()
+}
+
+// Publish points name at root. key must be the key of the owner of name.
+func (r *Resolver) Publish(key crypto.PrivKey, name Name, root cid.Cid) error {
+	var seq uint64
+	prev, err := r.record(name)
+	switch {
+	case err == nil:
+		seq = prev.Sequence + 1
+	case !errors.Is(err, ErrNameNotFound):
+		return err
+	}
+
+	rec, err := NewRecord(key, name, root, seq)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFile(r.recordPath(name), data)
+}
+
+// Identity returns the key names are published with, generating it on
+// first use.
+func (r *Resolver) Identity() (crypto.PrivKey, error) {
+	file := filepath.Join(r.dir, identityFile)
+
+	data, err := os.ReadFile(file)
+	if err == nil {
+		return crypto.UnmarshalPrivateKey(data)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if data, err = crypto.MarshalPrivateKey(key); err != nil {
+		return nil, err
+	}
+
+	if err = writeFile(file, data); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func (r *Resolver) record(name Name) (*Record, error) {
+	data, err := os.ReadFile(r.recordPath(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrNameNotFound, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var rec Record
+	if err = json.Unmarshal(data, &rec); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRecord, err)
+	}
+
+	if rec.Name != name.String() {
+		return nil, fmt.Errorf("%w: found %s instead of %s", ErrInvalidRecord, rec.Name, name)
+	}
+
+	return &rec, nil
+}
+
+func (r *Resolver) recordPath(name Name) string {
+	return filepath.Join(r.dir, namesDir, name.Owner.String(), name.Repo+".json")
+}
+
+// writeFile replaces file with data in one step, so readers never see a
+// partial record or key.
+func writeFile(file string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), file)
+}
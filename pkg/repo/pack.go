@@ -0,0 +1,303 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent/qp"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+
+	"github.com/peerforge/peerforge/pkg/blobdag"
+)
+
+// Layouts a repository stores its git objects with.
+const (
+	// LayoutObjects stores every object as its own block, addressed by its
+	// git hash, and large objects as blobdags.
+	LayoutObjects = "objects"
+	// LayoutPacks stores the objects of each push as a packfile, indexed
+	// by a PackIndex.
+	LayoutPacks = "packs"
+)
+
+// CheckLayout returns an error unless layout names a known layout.
+func CheckLayout(layout string) error {
+	if layout != LayoutObjects && layout != LayoutPacks {
+		return fmt.Errorf("unknown layout %q", layout)
+	}
+
+	return nil
+}
+
+// PackEntry locates an object within a packfile.
+type PackEntry struct {
+	Offset int64
+	Length int64
+}
+
+// PackIndex is the IPLD counterpart of the .idx file of a packfile. Its
+// entries are sharded by the first byte of their hash, like the fan-out
+// table of a .idx, so finding an object loads a single shard.
+//
+// It is stored as:
+//
+//	type PackIndex struct {
+//		pack   Link                 # blobdag of the packfile
+//		size   Int
+//		count  Int
+//		fanout {String:&PackShard}  # by the first two hex digits of hashes
+//	}
+//
+//	type PackShard {String:[Int]}   # hash to offset and length
+type PackIndex struct {
+	// Pack is the blobdag holding the packfile.
+	Pack cid.Cid
+	// Size is the size of the packfile in bytes.
+	Size int64
+	// Count is the number of objects in the packfile.
+	Count int64
+	// Fanout links to the shards of the index.
+	Fanout map[string]cid.Cid
+
+	mu     sync.Mutex
+	shards map[string]map[string]PackEntry
+}
+
+// StorePack writes pack, a packfile written by WritePack, as a blobdag of
+// chunkSize chunks along with the index of its entries, and returns the
+// CID of the index.
+func StorePack(ctx context.Context, ls *ipld.LinkSystem, pack []byte, entries map[string]PackEntry, chunkSize int) (cid.Cid, error) {
+	packCid, err := blobdag.Write(ctx, ls, pack, chunkSize)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("pack: %w", err)
+	}
+
+	shards := map[string]map[string]PackEntry{}
+	for sha, e := range entries {
+		if len(sha) < 2 {
+			return cid.Undef, fmt.Errorf("invalid hash %q", sha)
+		}
+
+		shard := shards[sha[:2]]
+		if shard == nil {
+			shard = map[string]PackEntry{}
+			shards[sha[:2]] = shard
+		}
+		shard[sha] = e
+	}
+
+	fanout := make(map[string]cid.Cid, len(shards))
+	for prefix, shard := range shards {
+		if fanout[prefix], err = storeShard(ctx, ls, shard); err != nil {
+			return cid.Undef, fmt.Errorf("pack shard %s: %w", prefix, err)
+		}
+	}
+
+	n, err := qp.BuildMap(basicnode.Prototype.Map, 4, func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, "pack", qp.Link(cidlink.Link{Cid: packCid}))
+		qp.MapEntry(ma, "size", qp.Int(int64(len(pack))))
+		qp.MapEntry(ma, "count", qp.Int(int64(len(entries))))
+		qp.MapEntry(ma, "fanout", linkMap(fanout))
+	})
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	lnk, err := ls.Store(ipld.LinkContext{Ctx: ctx}, LinkPrototype, n)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	return lnk.(cidlink.Link).Cid, nil
+}
+
+func storeShard(ctx context.Context, ls *ipld.LinkSystem, shard map[string]PackEntry) (cid.Cid, error) {
+	hashes := make([]string, 0, len(shard))
+	for sha := range shard {
+		hashes = append(hashes, sha)
+	}
+	sort.Strings(hashes)
+
+	n, err := qp.BuildMap(basicnode.Prototype.Map, int64(len(hashes)), func(ma datamodel.MapAssembler) {
+		for _, sha := range hashes {
+			e := shard[sha]
+			qp.MapEntry(ma, sha, qp.List(2, func(la datamodel.ListAssembler) {
+				qp.ListEntry(la, qp.Int(e.Offset))
+				qp.ListEntry(la, qp.Int(e.Length))
+			}))
+		}
+	})
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	lnk, err := ls.Store(ipld.LinkContext{Ctx: ctx}, LinkPrototype, n)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	return lnk.(cidlink.Link).Cid, nil
+}
+
+// LoadPackIndex reads the pack index stored under c. Its shards are only
+// loaded once an object is looked up in them.
+func LoadPackIndex(ctx context.Context, ls *ipld.LinkSystem, c cid.Cid) (*PackIndex, error) {
+	n, err := ls.Load(ipld.LinkContext{Ctx: ctx}, cidlink.Link{Cid: c}, basicnode.Prototype.Map)
+	if err != nil {
+		return nil, err
+	}
+
+	idx := &PackIndex{shards: map[string]map[string]PackEntry{}}
+
+	pack, err := n.LookupByString("pack")
+	if err != nil {
+		return nil, fmt.Errorf("pack index: %w", err)
+	}
+
+	lnk, err := pack.AsLink()
+	if err != nil {
+		return nil, fmt.Errorf("pack index: %w", err)
+	}
+	idx.Pack = lnk.(cidlink.Link).Cid
+
+	for name, v := range map[string]*int64{"size": &idx.Size, "count": &idx.Count} {
+		f, err := n.LookupByString(name)
+		if err != nil {
+			return nil, fmt.Errorf("pack index: %w", err)
+		}
+
+		if *v, err = f.AsInt(); err != nil {
+			return nil, fmt.Errorf("pack index %s: %w", name, err)
+		}
+	}
+
+	fanout, err := n.LookupByString("fanout")
+	if err != nil {
+		return nil, fmt.Errorf("pack index: %w", err)
+	}
+
+	if idx.Fanout, err = decodeLinkMap(fanout); err != nil {
+		return nil, fmt.Errorf("pack index fanout: %w", err)
+	}
+
+	return idx, nil
+}
+
+// Lookup returns where the object sha is in the packfile, and false when
+// it isn't part of it.
+func (idx *PackIndex) Lookup(ctx context.Context, ls *ipld.LinkSystem, sha string) (PackEntry, bool, error) {
+	if len(sha) < 2 {
+		return PackEntry{}, false, fmt.Errorf("invalid hash %q", sha)
+	}
+
+	prefix := sha[:2]
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	shard, ok := idx.shards[prefix]
+	if !ok {
+		c, ok := idx.Fanout[prefix]
+		if !ok {
+			return PackEntry{}, false, nil
+		}
+
+		var err error
+		if shard, err = loadShard(ctx, ls, c); err != nil {
+			return PackEntry{}, false, fmt.Errorf("pack shard %s: %w", prefix, err)
+		}
+
+		idx.shards[prefix] = shard
+	}
+
+	e, ok := shard[sha]
+
+	return e, ok, nil
+}
+
+// Object reads the object sha from the packfile, in its loose form, or
+// returns nil when it isn't part of it.
+func (idx *PackIndex) Object(ctx context.Context, ls *ipld.LinkSystem, sha string) ([]byte, error) {
+	e, ok, err := idx.Lookup(ctx, ls, sha)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	entry, err := blobdag.ReadAt(ctx, ls, idx.Pack, e.Offset, e.Length)
+	if err != nil {
+		return nil, fmt.Errorf("pack object %s: %w", sha, err)
+	}
+
+	raw, err := DecodePackEntry(entry)
+	if err != nil {
+		return nil, fmt.Errorf("pack object %s: %w", sha, err)
+	}
+
+	return raw, nil
+}
+
+// ReadPack reads the whole packfile.
+func (idx *PackIndex) ReadPack(ctx context.Context, ls *ipld.LinkSystem) (*bytes.Reader, error) {
+	data, err := blobdag.Read(ctx, ls, idx.Pack)
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(data)) != idx.Size {
+		return nil, fmt.Errorf("pack of %d bytes, expected %d", len(data), idx.Size)
+	}
+
+	return bytes.NewReader(data), nil
+}
+
+func loadShard(ctx context.Context, ls *ipld.LinkSystem, c cid.Cid) (map[string]PackEntry, error) {
+	n, err := ls.Load(ipld.LinkContext{Ctx: ctx}, cidlink.Link{Cid: c}, basicnode.Prototype.Map)
+	if err != nil {
+		return nil, err
+	}
+
+	it := n.MapIterator()
+	if it == nil {
+		return nil, fmt.Errorf("expected a map, got %s", n.Kind())
+	}
+
+	shard := make(map[string]PackEntry, n.Length())
+	for !it.Done() {
+		k, v, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		sha, err := k.AsString()
+		if err != nil {
+			return nil, err
+		}
+
+		if v.Length() != 2 {
+			return nil, fmt.Errorf("%s: expected offset and length", sha)
+		}
+
+		var e PackEntry
+		for i, f := range []*int64{&e.Offset, &e.Length} {
+			item, err := v.LookupByIndex(int64(i))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", sha, err)
+			}
+
+			if *f, err = item.AsInt(); err != nil {
+				return nil, fmt.Errorf("%s: %w", sha, err)
+			}
+		}
+
+		shard[sha] = e
+	}
+
+	return shard, nil
+}
@@ -0,0 +1,99 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/storage/memory"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/storage/memstore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPack(t *testing.T) {
+	ctx := context.Background()
+	ls := cidlink.DefaultLinkSystem()
+	st := &memstore.Store{}
+	ls.SetReadStorage(st)
+	ls.SetWriteStorage(st)
+
+	source := memory.NewStorage()
+	var hashes []plumbing.Hash
+	for i, content := range []string{"", "hello\n", string(bytes.Repeat([]byte("large "), 1<<14))} {
+		blob := &plumbing.MemoryObject{}
+		blob.SetType(plumbing.BlobObject)
+		_, err := blob.Write([]byte(content))
+		assert.NoError(t, err)
+
+		h, err := source.SetEncodedObject(blob)
+		assert.NoError(t, err, "blob %d", i)
+		hashes = append(hashes, h)
+	}
+
+	var buf bytes.Buffer
+	entries, err := WritePack(&buf, hashes, func(h plumbing.Hash) (plumbing.EncodedObject, error) {
+		return source.EncodedObject(plumbing.AnyObject, h)
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, entries, len(hashes))
+
+	parsed := memory.NewStorage()
+	parser, err := packfile.NewParserWithStorage(packfile.NewScanner(bytes.NewReader(buf.Bytes())), parsed)
+	assert.NoError(t, err)
+	_, err = parser.Parse()
+	assert.NoError(t, err, "git reads the pack")
+	assert.Len(t, parsed.Blobs, len(hashes))
+
+	c, err := StorePack(ctx, &ls, buf.Bytes(), entries, 1<<12)
+	assert.NoError(t, err)
+
+	idx, err := LoadPackIndex(ctx, &ls, c)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, int64(buf.Len()), idx.Size)
+	assert.Equal(t, int64(len(hashes)), idx.Count)
+
+	for _, h := range hashes {
+		obj, err := source.EncodedObject(plumbing.AnyObject, h)
+		assert.NoError(t, err)
+
+		raw, err := idx.Object(ctx, &ls, h.String())
+		assert.NoError(t, err)
+		assert.True(t, bytes.HasPrefix(raw, []byte(fmt.Sprintf("blob %d\x00", obj.Size()))), h)
+		assert.Equal(t, h, plumbing.ComputeHash(plumbing.BlobObject, raw[bytes.IndexByte(raw, 0)+1:]))
+	}
+
+	raw, err := idx.Object(ctx, &ls, "ada5ec06cbbdc9616a6e4a7cd43a7b078936368e")
+	assert.NoError(t, err)
+	assert.Nil(t, raw, "not in the pack")
+
+	r, err := idx.ReadPack(ctx, &ls)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(buf.Len()), r.Size())
+}
+
+func TestDecodePackEntry(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry []byte
+	}{
+		{name: "empty", entry: nil},
+		{name: "truncated header", entry: []byte{0xb5}},
+		{name: "delta", entry: []byte{0x75, 0x00}},
+		{name: "not compressed", entry: []byte{0x36, 'h', 'e', 'l', 'l', 'o', '\n'}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := DecodePackEntry(tt.entry)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package repo
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// packVersion is the version of the packfiles written by WritePack.
+const packVersion = 2
+
+// WritePack writes the objects hashes to w as a git packfile, reading them
+// with get, and returns where each one landed, by hash.
+//
+// Objects are never stored as deltas, so any of them can be read back on
+// its own from its entry with DecodePackEntry. The pack is larger than the
+// one git would write for the same objects, in exchange for serving single
+// objects with one ranged read.
+func WritePack(w io.Writer, hashes []plumbing.Hash, get func(plumbing.Hash) (plumbing.EncodedObject, error)) (map[string]PackEntry, error) {
+	sum := sha1.New()
+	cw := &countingWriter{w: io.MultiWriter(w, sum)}
+
+	header := make([]byte, 12)
+	copy(header, "PACK")
+	binary.BigEndian.PutUint32(header[4:], packVersion)
+	binary.BigEndian.PutUint32(header[8:], uint32(len(hashes)))
+
+	if _, err := cw.Write(header); err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]PackEntry, len(hashes))
+	for _, h := range hashes {
+		obj, err := get(h)
+		if err != nil {
+			return nil, fmt.Errorf("object %s: %w", h, err)
+		}
+
+		offset := cw.n
+		if err = writePackEntry(cw, obj); err != nil {
+			return nil, fmt.Errorf("object %s: %w", h, err)
+		}
+
+		entries[h.String()] = PackEntry{Offset: offset, Length: cw.n - offset}
+	}
+
+	if _, err := w.Write(sum.Sum(nil)); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+func writePackEntry(w io.Writer, obj plumbing.EncodedObject) error {
+	switch obj.Type() {
+	case plumbing.CommitObject, plumbing.TreeObject, plumbing.BlobObject, plumbing.TagObject:
+	default:
+		return fmt.Errorf("unexpected %s object", obj.Type())
+	}
+
+	// The size is spread over the low 4 bits of the first byte, next to
+	// the type, then 7 bits per byte, the high bit flagging continuation.
+	size := obj.Size()
+	b := byte(obj.Type())<<4 | byte(size&0x0f)
+	size >>= 4
+
+	var header []byte
+	for size != 0 {
+		header = append(header, b|0x80)
+		b = byte(size & 0x7f)
+		size >>= 7
+	}
+	header = append(header, b)
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	r, err := obj.Reader()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	zw := zlib.NewWriter(w)
+	if _, err = io.Copy(zw, r); err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+// DecodePackEntry decodes an entry of a packfile written by WritePack and
+// returns the object in its loose form, "<type> <size>\x00<content>".
+func DecodePackEntry(entry []byte) ([]byte, error) {
+	if len(entry) == 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	typ := plumbing.ObjectType(entry[0] >> 4 & 0x07)
+	size := int64(entry[0] & 0x0f)
+
+	i, shift := 0, uint(4)
+	for entry[i]&0x80 != 0 {
+		i++
+		if i == len(entry) || shift > 57 {
+			return nil, fmt.Errorf("invalid %s entry header", typ)
+		}
+
+		size |= int64(entry[i]&0x7f) << shift
+		shift += 7
+	}
+
+	switch typ {
+	case plumbing.CommitObject, plumbing.TreeObject, plumbing.BlobObject, plumbing.TagObject:
+	default:
+		return nil, fmt.Errorf("unexpected %s entry", typ)
+	}
+
+	zr, err := zlib.NewReader(bytes.NewReader(entry[i+1:]))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	var buf bytes.Buffer
+	buf.Grow(int(size) + 32)
+	_, _ = fmt.Fprintf(&buf, "%s %d\x00", typ, size)
+
+	n, err := io.Copy(&buf, zr)
+	if err != nil {
+		return nil, err
+	}
+	if n != size {
+		return nil, fmt.Errorf("%s entry of %d bytes, expected %d", typ, n, size)
+	}
+
+	return buf.Bytes(), nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+
+	return n, err
+}
@@ -0,0 +1,158 @@
+// Package repo defines how PeerForge lays out a git repository as IPLD data.
+package repo
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent/qp"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	mh "github.com/multiformats/go-multihash"
+
+	_ "github.com/ipld/go-ipld-prime/codec/dagcbor"
+)
+
+// LinkPrototype is used to store every node of the repository layout.
+var LinkPrototype = cidlink.LinkPrototype{Prefix: cid.Prefix{
+	Version:  1,
+	Codec:    cid.DagCBOR,
+	MhType:   mh.SHA2_256,
+	MhLength: -1,
+}}
+
+// Refs maps full ref names, e.g. "refs/heads/main" or
+// "refs/heads/team/feature", to the git hash they point at.
+type Refs map[string]string
+
+// Names returns the ref names in lexical order. When prefixes are given,
+// only names under one of them are returned.
+func (r Refs) Names(prefixes ...string) []string {
+	names := make([]string, 0, len(r))
+	for name := range r {
+		if len(prefixes) == 0 || hasAnyPrefix(name, prefixes) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// BuildRefsNode encodes refs as an IPLD map from ref name to a link to the
+// git object it points at, keeping the objects reachable from the node.
+func BuildRefsNode(refs Refs) (datamodel.Node, error) {
+	names := refs.Names()
+
+	return qp.BuildMap(basicnode.Prototype.Map, int64(len(names)), func(ma datamodel.MapAssembler) {
+		for _, name := range names {
+			c, err := cidFromHex(refs[name])
+			if err != nil {
+				panic(fmt.Errorf("ref %s: %w", name, err))
+			}
+
+			qp.MapEntry(ma, name, qp.Link(cidlink.Link{Cid: c}))
+		}
+	})
+}
+
+// DecodeRefs reads a node built by BuildRefsNode.
+func DecodeRefs(n datamodel.Node) (Refs, error) {
+	refs := make(Refs, n.Length())
+
+	it := n.MapIterator()
+	if it == nil {
+		return nil, fmt.Errorf("refs: expected a map, got %s", n.Kind())
+	}
+
+	for !it.Done() {
+		k, v, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		name, err := k.AsString()
+		if err != nil {
+			return nil, err
+		}
+
+		lnk, err := v.AsLink()
+		if err != nil {
+			return nil, fmt.Errorf("ref %s: %w", name, err)
+		}
+
+		sha, err := hexFromLink(lnk)
+		if err != nil {
+			return nil, fmt.Errorf("ref %s: %w", name, err)
+		}
+
+		refs[name] = sha
+	}
+
+	return refs, nil
+}
+
+// StoreRefs writes refs through ls and returns the CID of the node.
+func StoreRefs(ctx context.Context, ls *ipld.LinkSystem, refs Refs) (cid.Cid, error) {
+	n, err := BuildRefsNode(refs)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	lnk, err := ls.Store(ipld.LinkContext{Ctx: ctx}, LinkPrototype, n)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	return lnk.(cidlink.Link).Cid, nil
+}
+
+// LoadRefs reads the refs node stored under c.
+func LoadRefs(ctx context.Context, ls *ipld.LinkSystem, c cid.Cid) (Refs, error) {
+	n, err := ls.Load(ipld.LinkContext{Ctx: ctx}, cidlink.Link{Cid: c}, basicnode.Prototype.Map)
+	if err != nil {
+		return nil, err
+	}
+
+	return DecodeRefs(n)
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// cidFromHex addresses a git object by its SHA-1, the same way the object
+// store does.
+func cidFromHex(sha string) (cid.Cid, error) {
+	hash, err := mh.FromHexString("1114" + sha)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	return cid.NewCidV1(cid.GitRaw, hash), nil
+}
+
+func hexFromLink(lnk datamodel.Link) (string, error) {
+	cl, ok := lnk.(cidlink.Link)
+	if !ok || cl.Cid.Type() != cid.GitRaw {
+		return "", fmt.Errorf("unexpected link to %s", lnk)
+	}
+
+	decoded, err := mh.Decode(cl.Cid.Hash())
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", decoded.Digest), nil
+}
@@ -0,0 +1,57 @@
+package repo
+
+import (
+	"context"
+	"testing"
+
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/storage/memstore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRefs_RoundTrip(t *testing.T) {
+	ctx := context.Background()
+	ls := cidlink.DefaultLinkSystem()
+	st := &memstore.Store{}
+	ls.SetReadStorage(st)
+	ls.SetWriteStorage(st)
+
+	refs := Refs{
+		"refs/heads/main":              "ada5ec06cbbdc9616a6e4a7cd43a7b078936368e",
+		"refs/heads/team/feature/deep": "1b2d5d6bb4bf2c0b8eb7a4d8dc6a93e8d2ac16a0",
+		"refs/tags/v1.0.0":             "0f1e7f9b47c3d5e51e8c6a4b6a4c3e7d1c2b3a40",
+		"refs/tags/v1.0.0^{}":          "ada5ec06cbbdc9616a6e4a7cd43a7b078936368e",
+		"refs/notes/commits":           "9e26dfeeb6e641a33dae4961196235bdb965b21b",
+	}
+
+	c, err := StoreRefs(ctx, &ls, refs)
+	assert.NoError(t, err)
+
+	got, err := LoadRefs(ctx, &ls, c)
+	assert.NoError(t, err)
+	assert.Equal(t, refs, got)
+
+	again, err := StoreRefs(ctx, &ls, got)
+	assert.NoError(t, err)
+	assert.Equal(t, c, again, "refs nodes are content-addressed")
+}
+
+func TestRefs_Names(t *testing.T) {
+	refs := Refs{
+		"refs/heads/main":         "",
+		"refs/heads/team/feature": "",
+		"refs/tags/v1":            "",
+		"refs/tags/v1^{}":         "",
+		"refs/notes/commits":      "",
+	}
+
+	assert.Equal(t, []string{
+		"refs/heads/main",
+		"refs/heads/team/feature",
+		"refs/notes/commits",
+		"refs/tags/v1",
+		"refs/tags/v1^{}",
+	}, refs.Names())
+	assert.Equal(t, []string{"refs/heads/main", "refs/heads/team/feature"}, refs.Names("refs/heads/"))
+	assert.Equal(t, []string{"refs/heads/team/feature", "refs/tags/v1", "refs/tags/v1^{}"}, refs.Names("refs/heads/team/", "refs/tags/"))
+}
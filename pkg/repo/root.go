@@ -0,0 +1,313 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	"github.com/ipld/go-ipld-prime/fluent/qp"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+)
+
+// Root is an immutable snapshot of a repository. Every push stores a new
+// one linking to the root it was based on, so the chain of parents is the
+// push history of the repository.
+//
+// It is stored as:
+//
+//	type Root struct {
+//		refs     &Refs
+//		head     optional String
+//		objects  {String:Link}
+//		lfs      optional {String:Link}
+//		chunking optional Chunking
+//		layout   optional String
+//		packs    optional [&PackIndex]
+//		parent   optional &Root
+//	}
+//
+//	type Chunking struct {
+//		threshold Int
+//		chunkSize Int
+//	}
+type Root struct {
+	Refs Refs
+	// Head is the ref HEAD points at, empty when the repository has none.
+	Head string
+	// Objects indexes the git objects stored outside of the regular object
+	// store because of their size, by hash, to the blobdag holding them.
+	Objects map[string]cid.Cid
+	// LFS indexes the Git LFS objects of the repository, by oid, to the
+	// blobdag holding them.
+	LFS map[string]cid.Cid
+	// Chunking records how the latest push split large objects, so other
+	// clients keep writing them the same way.
+	Chunking Chunking
+	// Layout is the layout new objects are stored with, LayoutObjects when
+	// empty. Objects already stored keep theirs.
+	Layout string
+	// Packs links to the indexes of the packfiles of the repository, in
+	// the order they were pushed.
+	Packs []cid.Cid
+	// Parent is the root this one was pushed on top of, cid.Undef for the
+	// first push of a repository.
+	Parent cid.Cid
+}
+
+// Chunking holds the large object settings of a repository.
+type Chunking struct {
+	// Threshold is the size above which objects are stored as blobdags.
+	Threshold int64
+	// ChunkSize is the average size of the chunks of a blobdag.
+	ChunkSize int64
+}
+
+// NewRoot returns the root of an empty repository.
+func NewRoot() *Root {
+	return &Root{Refs: Refs{}, Objects: map[string]cid.Cid{}, LFS: map[string]cid.Cid{}}
+}
+
+// Next returns a copy of r meant to become its child, with Parent set to c.
+func (r *Root) Next(c cid.Cid) *Root {
+	next := &Root{
+		Refs:     make(Refs, len(r.Refs)),
+		Head:     r.Head,
+		Objects:  make(map[string]cid.Cid, len(r.Objects)),
+		LFS:      make(map[string]cid.Cid, len(r.LFS)),
+		Chunking: r.Chunking,
+		Layout:   r.Layout,
+		Packs:    append([]cid.Cid(nil), r.Packs...),
+		Parent:   c,
+	}
+
+	for name, hash := range r.Refs {
+		next.Refs[name] = hash
+	}
+
+	for hash, c := range r.Objects {
+		next.Objects[hash] = c
+	}
+
+	for oid, c := range r.LFS {
+		next.LFS[oid] = c
+	}
+
+	return next
+}
+
+// StoreRoot writes r and its refs through ls and returns the CID of the root.
+func StoreRoot(ctx context.Context, ls *ipld.LinkSystem, r *Root) (cid.Cid, error) {
+	refs, err := StoreRefs(ctx, ls, r.Refs)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	n, err := qp.BuildMap(basicnode.Prototype.Map, -1, func(ma datamodel.MapAssembler) {
+		qp.MapEntry(ma, "refs", qp.Link(cidlink.Link{Cid: refs}))
+		if r.Head != "" {
+			qp.MapEntry(ma, "head", qp.String(r.Head))
+		}
+		qp.MapEntry(ma, "objects", linkMap(r.Objects))
+		if len(r.LFS) > 0 {
+			qp.MapEntry(ma, "lfs", linkMap(r.LFS))
+		}
+		if r.Chunking != (Chunking{}) {
+			qp.MapEntry(ma, "chunking", qp.Map(2, func(ma datamodel.MapAssembler) {
+				qp.MapEntry(ma, "threshold", qp.Int(r.Chunking.Threshold))
+				qp.MapEntry(ma, "chunkSize", qp.Int(r.Chunking.ChunkSize))
+			}))
+		}
+		if r.Layout != "" {
+			qp.MapEntry(ma, "layout", qp.String(r.Layout))
+		}
+		if len(r.Packs) > 0 {
+			qp.MapEntry(ma, "packs", qp.List(int64(len(r.Packs)), func(la datamodel.ListAssembler) {
+				for _, c := range r.Packs {
+					qp.ListEntry(la, qp.Link(cidlink.Link{Cid: c}))
+				}
+			}))
+		}
+		if r.Parent.Defined() {
+			qp.MapEntry(ma, "parent", qp.Link(cidlink.Link{Cid: r.Parent}))
+		}
+	})
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	lnk, err := ls.Store(ipld.LinkContext{Ctx: ctx}, LinkPrototype, n)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	return lnk.(cidlink.Link).Cid, nil
+}
+
+// LoadRoot reads the root stored under c along with its refs.
+func LoadRoot(ctx context.Context, ls *ipld.LinkSystem, c cid.Cid) (*Root, error) {
+	n, err := ls.Load(ipld.LinkContext{Ctx: ctx}, cidlink.Link{Cid: c}, basicnode.Prototype.Map)
+	if err != nil {
+		return nil, err
+	}
+
+	refsLink, err := linkField(n, "refs")
+	if err != nil {
+		return nil, err
+	}
+
+	r := NewRoot()
+	if r.Refs, err = LoadRefs(ctx, ls, refsLink); err != nil {
+		return nil, err
+	}
+
+	if head, err := n.LookupByString("head"); err == nil {
+		if r.Head, err = head.AsString(); err != nil {
+			return nil, fmt.Errorf("root head: %w", err)
+		}
+	}
+
+	if r.Parent, err = linkField(n, "parent"); err != nil && !isMissing(err) {
+		return nil, err
+	}
+
+	if chunking, err := n.LookupByString("chunking"); err == nil {
+		if r.Chunking, err = decodeChunking(chunking); err != nil {
+			return nil, fmt.Errorf("root chunking: %w", err)
+		}
+	}
+
+	if layout, err := n.LookupByString("layout"); err == nil {
+		if r.Layout, err = layout.AsString(); err != nil {
+			return nil, fmt.Errorf("root layout: %w", err)
+		}
+	}
+
+	if packs, err := n.LookupByString("packs"); err == nil {
+		if r.Packs, err = decodeLinkList(packs); err != nil {
+			return nil, fmt.Errorf("root packs: %w", err)
+		}
+	}
+
+	objects, err := n.LookupByString("objects")
+	if err != nil {
+		return nil, fmt.Errorf("root objects: %w", err)
+	}
+
+	if r.Objects, err = decodeLinkMap(objects); err != nil {
+		return nil, fmt.Errorf("root objects: %w", err)
+	}
+
+	if lfs, err := n.LookupByString("lfs"); err == nil {
+		if r.LFS, err = decodeLinkMap(lfs); err != nil {
+			return nil, fmt.Errorf("root lfs: %w", err)
+		}
+	}
+
+	return r, nil
+}
+
+// linkMap assembles m as a map with its keys in order.
+func linkMap(m map[string]cid.Cid) qp.Assemble {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return qp.Map(int64(len(keys)), func(ma datamodel.MapAssembler) {
+		for _, k := range keys {
+			qp.MapEntry(ma, k, qp.Link(cidlink.Link{Cid: m[k]}))
+		}
+	})
+}
+
+func decodeLinkMap(n datamodel.Node) (map[string]cid.Cid, error) {
+	it := n.MapIterator()
+	if it == nil {
+		return nil, fmt.Errorf("expected a map, got %s", n.Kind())
+	}
+
+	m := make(map[string]cid.Cid, n.Length())
+	for !it.Done() {
+		k, v, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := k.AsString()
+		if err != nil {
+			return nil, err
+		}
+
+		lnk, err := v.AsLink()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+
+		m[key] = lnk.(cidlink.Link).Cid
+	}
+
+	return m, nil
+}
+
+func decodeLinkList(n datamodel.Node) ([]cid.Cid, error) {
+	it := n.ListIterator()
+	if it == nil {
+		return nil, fmt.Errorf("expected a list, got %s", n.Kind())
+	}
+
+	links := make([]cid.Cid, 0, n.Length())
+	for !it.Done() {
+		_, v, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		lnk, err := v.AsLink()
+		if err != nil {
+			return nil, err
+		}
+
+		links = append(links, lnk.(cidlink.Link).Cid)
+	}
+
+	return links, nil
+}
+
+func decodeChunking(n datamodel.Node) (c Chunking, err error) {
+	for name, v := range map[string]*int64{"threshold": &c.Threshold, "chunkSize": &c.ChunkSize} {
+		f, err := n.LookupByString(name)
+		if err != nil {
+			return Chunking{}, err
+		}
+
+		if *v, err = f.AsInt(); err != nil {
+			return Chunking{}, err
+		}
+	}
+
+	return c, nil
+}
+
+func linkField(n datamodel.Node, name string) (cid.Cid, error) {
+	v, err := n.LookupByString(name)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	lnk, err := v.AsLink()
+	if err != nil {
+		return cid.Undef, fmt.Errorf("root %s: %w", name, err)
+	}
+
+	return lnk.(cidlink.Link).Cid, nil
+}
+
+func isMissing(err error) bool {
+	_, ok := err.(datamodel.ErrNotExists)
+	return ok
+}
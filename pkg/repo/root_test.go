@@ -0,0 +1,52 @@
+package repo
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/storage/memstore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoot_History(t *testing.T) {
+	ctx := context.Background()
+	ls := cidlink.DefaultLinkSystem()
+	st := &memstore.Store{}
+	ls.SetReadStorage(st)
+	ls.SetWriteStorage(st)
+
+	blob, err := cidFromHex("9e26dfeeb6e641a33dae4961196235bdb965b21b")
+	assert.NoError(t, err)
+
+	first := NewRoot()
+	first.Refs["refs/heads/trunk"] = "ada5ec06cbbdc9616a6e4a7cd43a7b078936368e"
+	first.Head = "refs/heads/trunk"
+
+	c1, err := StoreRoot(ctx, &ls, first)
+	assert.NoError(t, err)
+
+	got, err := LoadRoot(ctx, &ls, c1)
+	assert.NoError(t, err)
+	assert.Equal(t, first, got)
+	assert.Equal(t, cid.Undef, got.Parent)
+
+	second := got.Next(c1)
+	second.Refs["refs/heads/trunk"] = "1b2d5d6bb4bf2c0b8eb7a4d8dc6a93e8d2ac16a0"
+	second.Objects["9e26dfeeb6e641a33dae4961196235bdb965b21b"] = blob
+	second.Chunking = Chunking{Threshold: 1 << 21, ChunkSize: 1 << 18}
+	second.LFS["4d7a214614ab2935c943f9e0ff69d22eadbb8f32b1258daaa5e2ca24d17e2393"] = blob
+	second.Layout = LayoutPacks
+	second.Packs = []cid.Cid{blob}
+
+	c2, err := StoreRoot(ctx, &ls, second)
+	assert.NoError(t, err)
+	assert.NotEqual(t, c1, c2)
+	assert.Equal(t, "ada5ec06cbbdc9616a6e4a7cd43a7b078936368e", got.Refs["refs/heads/trunk"], "Next copies refs")
+
+	got, err = LoadRoot(ctx, &ls, c2)
+	assert.NoError(t, err)
+	assert.Equal(t, second, got)
+	assert.Equal(t, c1, got.Parent)
+}